@@ -0,0 +1,542 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 備份檔格式
+const (
+	formatZip    = "zip"
+	formatTarGz  = "tar.gz"
+	formatTarZst = "tar.zst"
+)
+
+var archiveFormats = []string{formatZip, formatTarGz, formatTarZst}
+
+// archiveFormat 依副檔名判斷備份檔格式 (忽略 .age) 不是備份檔時回傳空字串
+func archiveFormat(name string) string {
+	name = strings.TrimSuffix(name, encryptedSuffix)
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(name, "."+format) {
+			return format
+		}
+	}
+	return ""
+}
+
+// archiveHeader 備份檔中的一個項目
+type archiveHeader struct {
+	Name     string
+	Size     int64
+	Mode     fs.FileMode
+	Modified time.Time
+}
+
+// archiveWriter 備份檔寫入器 writeEntry 不可同時呼叫
+type archiveWriter interface {
+	writeEntry(header archiveHeader, reader io.Reader) error
+	Close() error
+}
+
+// parallelArchiveWriter 每個項目可獨立壓縮的格式 (zip)
+// compressEntry 可由多個 worker 同時呼叫 writeCompressed 不可同時呼叫
+type parallelArchiveWriter interface {
+	archiveWriter
+	compressEntry(header archiveHeader, reader io.Reader) (*compressedEntry, error)
+	writeCompressed(entry *compressedEntry) error
+}
+
+// 壓縮後的項目超過此大小時改寫入暫存檔
+const compressSpillSize = 16 << 20
+
+// auto_store 取樣檔案開頭的大小 壓縮後仍超過 storeSampleRatio 時不壓縮
+const (
+	storeSampleSize  = 64 << 10
+	storeSampleRatio = 0.95
+)
+
+// newArchiveWriter tempDir 為 zip 壓縮時暫存檔的位置 設定加密時壓縮後的資料再經過 age 加密
+func newArchiveWriter(format string, out io.Writer, tempDir string) (archiveWriter, error) {
+	if !slices.Contains(archiveFormats, format) {
+		return nil, fmt.Errorf(I18n("config_backup_format_invalid"), format)
+	}
+	encryptor, err := encryptWriter(out)
+	if err != nil {
+		return nil, err
+	}
+	if encryptor != nil {
+		out = encryptor
+	}
+
+	switch format {
+	case formatZip:
+		zipWriter := zip.NewWriter(out)
+		zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, config.Backup.CompressionLevel)
+		})
+		return &zipArchiveWriter{writer: zipWriter, tempDir: tempDir, encryptor: encryptor}, nil
+	case formatTarGz:
+		compressor, err := gzip.NewWriterLevel(out, config.Backup.CompressionLevel)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveWriter{writer: tar.NewWriter(compressor), compressor: compressor, encryptor: encryptor}, nil
+	default:
+		compressor, err := zstd.NewWriter(out,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(config.Backup.CompressionLevel)),
+			zstd.WithEncoderConcurrency(config.Backup.Workers))
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveWriter{writer: tar.NewWriter(compressor), compressor: compressor, encryptor: encryptor}, nil
+	}
+}
+
+// closeEncryptor 寫入最後一個加密區塊 只執行一次
+func closeEncryptor(encryptor *io.WriteCloser) error {
+	if *encryptor == nil {
+		return nil
+	}
+	err := (*encryptor).Close()
+	*encryptor = nil
+	return err
+}
+
+type zipArchiveWriter struct {
+	writer    *zip.Writer
+	tempDir   string
+	encryptor io.WriteCloser
+}
+
+func (z *zipArchiveWriter) writeEntry(header archiveHeader, reader io.Reader) error {
+	zipHeader := &zip.FileHeader{
+		Name:     header.Name,
+		Method:   zip.Deflate,
+		Modified: header.Modified,
+	}
+	zipHeader.SetMode(header.Mode)
+	writer, err := z.writer.CreateHeader(zipHeader)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+func (z *zipArchiveWriter) Close() error {
+	if err := z.writer.Close(); err != nil {
+		return err
+	}
+	return closeEncryptor(&z.encryptor)
+}
+
+var flateWriterPool sync.Pool
+
+// compressEntry 在 worker 中壓縮項目 並計算 CRC 與大小供 CreateRaw 使用
+func (z *zipArchiveWriter) compressEntry(header archiveHeader, reader io.Reader) (*compressedEntry, error) {
+	entry := &compressedEntry{header: &zip.FileHeader{
+		Name:     header.Name,
+		Method:   zip.Deflate,
+		Modified: header.Modified,
+	}}
+	entry.header.SetMode(header.Mode)
+	entry.data.dir = z.tempDir
+
+	buffered := bufio.NewReaderSize(reader, storeSampleSize)
+	reader = buffered
+	if storeEntry(header.Name, buffered) {
+		entry.header.Method = zip.Store
+		crc := crc32.NewIEEE()
+		size, err := io.Copy(io.MultiWriter(&entry.data, crc), reader)
+		if err != nil {
+			entry.Close()
+			return nil, err
+		}
+		entry.header.CRC32 = crc.Sum32()
+		entry.header.UncompressedSize64 = uint64(size)
+		entry.header.CompressedSize64 = uint64(size)
+		return entry, nil
+	}
+
+	compressor, _ := flateWriterPool.Get().(*flate.Writer)
+	if compressor == nil {
+		var err error
+		if compressor, err = flate.NewWriter(&entry.data, config.Backup.CompressionLevel); err != nil {
+			return nil, err
+		}
+	} else {
+		compressor.Reset(&entry.data)
+	}
+	defer flateWriterPool.Put(compressor)
+
+	crc := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(compressor, crc), reader)
+	if err == nil {
+		err = compressor.Close()
+	}
+	if err != nil {
+		entry.Close()
+		return nil, err
+	}
+	entry.header.CRC32 = crc.Sum32()
+	entry.header.UncompressedSize64 = uint64(size)
+	entry.header.CompressedSize64 = uint64(entry.data.size)
+	return entry, nil
+}
+
+// storeEntry 是否不壓縮直接儲存 (符合 store 規則 或 auto_store 取樣後壓縮沒有效果)
+func storeEntry(name string, reader *bufio.Reader) bool {
+	for _, pattern := range config.Backup.Store {
+		pattern = filepath.ToSlash(pattern)
+		// 不含 / 的規則只比對檔名
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(name)
+		}
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	if !config.Backup.AutoStore {
+		return false
+	}
+
+	sample, _ := reader.Peek(storeSampleSize)
+	if len(sample) == 0 {
+		return false
+	}
+	var compressed byteCounter
+	compressor, err := flate.NewWriter(&compressed, flate.BestSpeed)
+	if err != nil {
+		return false
+	}
+	compressor.Write(sample)
+	compressor.Close()
+	return float64(compressed) >= float64(len(sample))*storeSampleRatio
+}
+
+// byteCounter 只計算寫入的位元組數
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// writeCompressed 將已壓縮的資料直接寫入 zip
+func (z *zipArchiveWriter) writeCompressed(entry *compressedEntry) error {
+	writer, err := z.writer.CreateRaw(entry.header)
+	if err != nil {
+		return err
+	}
+	reader, err := entry.data.reader()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+// compressedEntry 已壓縮 等待寫入的項目
+type compressedEntry struct {
+	header *zip.FileHeader
+	data   spillBuffer
+}
+
+func (e *compressedEntry) Close() error {
+	return e.data.Close()
+}
+
+// spillBuffer 先寫入記憶體 超過 compressSpillSize 後改寫入 dir 中的暫存檔
+type spillBuffer struct {
+	dir    string
+	memory bytes.Buffer
+	file   *os.File
+	size   int64
+}
+
+func (s *spillBuffer) Write(p []byte) (int, error) {
+	if s.file == nil && s.memory.Len()+len(p) > compressSpillSize {
+		file, err := os.CreateTemp(s.dir, "compress-*"+partialSuffix)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := file.Write(s.memory.Bytes()); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return 0, err
+		}
+		s.file = file
+		s.memory = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.memory.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// reader 從頭讀取已寫入的資料
+func (s *spillBuffer) reader() (io.Reader, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.memory.Bytes()), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+func (s *spillBuffer) Close() error {
+	s.memory = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+type tarArchiveWriter struct {
+	writer     *tar.Writer
+	compressor io.WriteCloser
+	encryptor  io.WriteCloser
+}
+
+// writeEntry tar 需要事先知道大小 檔案在讀取中變短時補零 保持 tar 結構完整
+func (t *tarArchiveWriter) writeEntry(header archiveHeader, reader io.Reader) error {
+	err := t.writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     header.Name,
+		Size:     header.Size,
+		Mode:     int64(header.Mode.Perm()),
+		ModTime:  header.Modified,
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.CopyN(t.writer, reader, header.Size)
+	if n < header.Size {
+		if _, padErr := io.CopyN(t.writer, zeroReader{}, header.Size-n); padErr != nil {
+			return padErr
+		}
+		if err == nil || errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return err
+}
+
+func (t *tarArchiveWriter) Close() error {
+	if err := t.writer.Close(); err != nil {
+		t.compressor.Close()
+		return err
+	}
+	if err := t.compressor.Close(); err != nil {
+		return err
+	}
+	return closeEncryptor(&t.encryptor)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// openTarReader 解密並解壓 tar.gz / tar.zst
+func openTarReader(path string) (io.Reader, io.Closer, error) {
+	reader, file, err := openArchiveFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch archiveFormat(path) {
+	case formatTarGz:
+		decompressor, err := gzip.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return decompressor, file, nil
+	case formatTarZst:
+		decompressor, err := zstd.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return decompressor, closerFunc(func() error {
+			decompressor.Close()
+			return file.Close()
+		}), nil
+	default:
+		file.Close()
+		return nil, nil, fmt.Errorf(I18n("config_backup_format_invalid"), path)
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// walkArchive 依序讀取備份檔中的所有檔案 (包含 manifest.json)
+func walkArchive(path string, fn func(entry backupEntry, reader io.Reader) error) error {
+	if archiveFormat(path) == formatZip {
+		zipReader, closer, err := openZipArchive(path)
+		if err != nil {
+			return err
+		}
+		defer closer.Close()
+		for _, f := range zipReader.File {
+			if strings.HasSuffix(f.Name, "/") {
+				continue
+			}
+			reader, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(backupEntry{Name: f.Name, Size: int64(f.UncompressedSize64), Modified: f.Modified}, reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	decompressor, closer, err := openTarReader(path)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	tarReader := tar.NewReader(decompressor)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			// 讀完剩餘的壓縮資料 讓 gzip / zstd 檢查校驗碼
+			_, err = io.Copy(io.Discard, decompressor)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(backupEntry{Name: header.Name, Size: header.Size, Modified: header.ModTime}, tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+// readArchiveManifest 讀取備份檔內的 manifest.json 舊備份沒有時回傳 nil
+func readArchiveManifest(path string) (*Manifest, error) {
+	if archiveFormat(path) == formatZip {
+		zipReader, closer, err := openZipArchive(path)
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		return readManifest(zipReader)
+	}
+
+	var manifest *Manifest
+	err := walkArchive(path, func(entry backupEntry, reader io.Reader) error {
+		if entry.Name != manifestFileName {
+			return nil
+		}
+		var err error
+		manifest, err = decodeManifest(reader)
+		return err
+	})
+	return manifest, err
+}
+
+// decodeManifest
+func decodeManifest(reader io.Reader) (*Manifest, error) {
+	manifest := &Manifest{}
+	if err := json.NewDecoder(reader).Decode(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// tarSource tar 只能依序讀取 開啟時先掃描一次取得項目清單
+// 讀取中變短而補零的項目記錄在 manifest.Failed 中 還原時略過
+type tarSource struct {
+	path   string
+	files  []backupEntry
+	failed map[string]bool
+}
+
+// openTarSource
+func openTarSource(path string) (*tarSource, *Manifest, error) {
+	source := &tarSource{path: path}
+	var manifest *Manifest
+	err := walkArchive(path, func(entry backupEntry, reader io.Reader) error {
+		if entry.Name != manifestFileName {
+			source.files = append(source.files, entry)
+			return nil
+		}
+		var err error
+		manifest, err = decodeManifest(reader)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if manifest != nil && len(manifest.Failed) > 0 {
+		source.failed = make(map[string]bool)
+		for _, f := range manifest.Failed {
+			source.failed[f.Path] = true
+		}
+		source.files = slices.DeleteFunc(source.files, func(entry backupEntry) bool {
+			return source.failed[entry.Name]
+		})
+	}
+	return source, manifest, nil
+}
+
+func (t *tarSource) entries() []backupEntry {
+	return t.files
+}
+
+func (t *tarSource) walk(fn func(entry backupEntry, reader io.Reader) error) error {
+	return walkArchive(t.path, func(entry backupEntry, reader io.Reader) error {
+		if entry.Name == manifestFileName || t.failed[entry.Name] {
+			return nil
+		}
+		return fn(entry, reader)
+	})
+}
+
+func (t *tarSource) Close() error {
+	return nil
+}
\ No newline at end of file
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// generateWorld 建立類似世界存檔的目錄 region 檔案一半是可壓縮的資料 一半是隨機資料
+func generateWorld(b *testing.B) ([]string, int64) {
+	dir := b.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	var files []string
+	var total int64
+	for i := 0; i < 32; i++ {
+		data := make([]byte, 1<<20)
+		rng.Read(data[:len(data)/2])
+		for j := len(data) / 2; j < len(data); j++ {
+			data[j] = byte(j % 64)
+		}
+		path := filepath.Join(dir, "world", "region", fmt.Sprintf("r.%d.0.mca", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			b.Fatal(err)
+		}
+		files = append(files, path)
+		total += int64(len(data))
+	}
+	return files, total
+}
+
+// BenchmarkCreateArchive zip 壓縮的吞吐量隨 workers 增加
+func BenchmarkCreateArchive(b *testing.B) {
+	files, total := generateWorld(b)
+	config.Backup.CompressionLevel = 5
+	config.Backup.AutoStore = false
+	config.Backup.Encryption = BackupEncryption{}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Workers=%d", workers), func(b *testing.B) {
+			config.Backup.Workers = workers
+			out := filepath.Join(b.TempDir(), "backup.zip")
+			b.SetBytes(total)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := createArchive(out, formatZip, files, newManifest()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
\ No newline at end of file
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"strings"
+	"time"
+)
+
+// backupEntry 備份中的一個檔案
+type backupEntry struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+// backupSource 可讀取的備份 (zip / tar 增量備份 或倉庫 snapshot)
+type backupSource interface {
+	entries() []backupEntry
+	walk(fn func(entry backupEntry, reader io.Reader) error) error
+	Close() error
+}
+
+// openBackup 依備份類型開啟
+func openBackup(path string) (backupSource, error) {
+	if strings.HasSuffix(path, ".json") {
+		return openSnapshotSource(path)
+	}
+	source, manifest, err := openArchiveSource(path)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil || manifest.Base == "" {
+		return source, nil
+	}
+	incremental, err := openIncrementalSource(source, manifest, backupDir(path))
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	return incremental, nil
+}
+
+// openArchiveSource 開啟 zip / tar 備份檔 並讀取其中的 manifest
+func openArchiveSource(path string) (backupSource, *Manifest, error) {
+	if archiveFormat(path) != formatZip {
+		return openTarSource(path)
+	}
+	zipReader, closer, err := openZipArchive(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := readManifest(zipReader)
+	if err != nil {
+		manifest = nil
+	}
+	return &zipSource{reader: zipReader, closer: closer}, manifest, nil
+}
+
+type zipSource struct {
+	reader *zip.Reader
+	closer io.Closer
+}
+
+func (z *zipSource) files() []*zip.File {
+	var files []*zip.File
+	for _, f := range z.reader.File {
+		if !strings.HasSuffix(f.Name, "/") && f.Name != manifestFileName {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (z *zipSource) entries() []backupEntry {
+	var entries []backupEntry
+	for _, f := range z.files() {
+		entries = append(entries, backupEntry{Name: f.Name, Size: int64(f.UncompressedSize64), Modified: f.Modified})
+	}
+	return entries
+}
+
+func (z *zipSource) walk(fn func(entry backupEntry, reader io.Reader) error) error {
+	for _, f := range z.files() {
+		reader, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(backupEntry{Name: f.Name, Size: int64(f.UncompressedSize64), Modified: f.Modified}, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *zipSource) Close() error {
+	return z.closer.Close()
+}
+
+type snapshotSource struct {
+	repo     *repository
+	snapshot *Snapshot
+}
+
+// openSnapshotSource
+func openSnapshotSource(path string) (*snapshotSource, error) {
+	snapshot, err := loadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := openRepository(backupDir(path))
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotSource{repo: repo, snapshot: snapshot}, nil
+}
+
+func (s *snapshotSource) entries() []backupEntry {
+	var entries []backupEntry
+	for _, f := range s.snapshot.Files {
+		entries = append(entries, backupEntry{Name: f.Path, Size: f.Size, Modified: f.ModTime})
+	}
+	return entries
+}
+
+func (s *snapshotSource) walk(fn func(entry backupEntry, reader io.Reader) error) error {
+	for _, f := range s.snapshot.Files {
+		if err := fn(backupEntry{Name: f.Path, Size: f.Size, Modified: f.ModTime}, s.repo.fileReader(f)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *snapshotSource) Close() error {
+	return nil
+}
\ No newline at end of file
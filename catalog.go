@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+)
+
+// 備份目錄中的備份清單檔
+const catalogFileName = "catalog.json"
+
+// 修改備份清單時取得的鎖 讓其他行程 (例如命令列) 等待
+const catalogLockName = "catalog.json.lock"
+
+// 備份檔名中的時間格式
+const backupTimeFormat = "2006-01-02_15-04-05"
+
+// 備份觸發來源
+const (
+	triggerStartup   = "startup"
+	triggerScheduled = "scheduled"
+	triggerManual    = "manual"
+	triggerUnknown   = "unknown"
+)
+
+var catalogMutex sync.Mutex
+
+// BackupRecord 一個備份檔的紀錄
+type BackupRecord struct {
+	File     string        `json:"file"`
+	Time     time.Time     `json:"time"`
+	Size     int64         `json:"size"`
+	RawSize  int64         `json:"raw_size,omitempty"`
+	Files    int           `json:"files"`
+	Duration time.Duration `json:"duration"`
+	Trigger  string        `json:"trigger"`
+	By       string        `json:"by,omitempty"`
+	Partial  bool          `json:"partial,omitempty"`
+	Verified string        `json:"verified,omitempty"`
+	Base     string        `json:"base,omitempty"`
+	Job      string        `json:"job,omitempty"`
+	Label    string        `json:"label,omitempty"`
+	Pinned   bool          `json:"pinned,omitempty"`
+	// Replicated 已複製到的遠端 只記錄在本機的 catalog
+	Replicated []string `json:"replicated,omitempty"`
+}
+
+type backupCatalog struct {
+	Backups []BackupRecord `json:"backups"`
+}
+
+// updateCatalog 讀取備份目錄 dir 的 catalog 交給 fn 修改後寫回
+func updateCatalog(dir string, fn func(c *backupCatalog) error) error {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	unlock, err := lockFile(filepath.Join(dir, catalogLockName))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := filepath.Join(dir, catalogFileName)
+	c := &backupCatalog{}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, c); err != nil {
+			log.Printf(I18n("catalog_parse_failed"), path, err)
+			c = &backupCatalog{}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := fn(c); err != nil {
+		return err
+	}
+
+	data, err = json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// sync 與備份目錄比對 移除已不存在的紀錄 並登記未知的備份檔
+func (c *backupCatalog) sync(dir string) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	onDisk := make(map[string]os.FileInfo)
+	for _, file := range files {
+		if file.IsDir() || !isBackupFile(file.Name()) {
+			continue
+		}
+		if info, err := file.Info(); err == nil {
+			onDisk[file.Name()] = info
+		}
+	}
+
+	snapshotDir := filepath.Join(dir, repositoryDirName, snapshotsDirName)
+	snapshots, err := os.ReadDir(snapshotDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, file := range snapshots {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), "backup-") || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		if info, err := file.Info(); err == nil {
+			onDisk[repositoryDirName+"/"+snapshotsDirName+"/"+file.Name()] = info
+		}
+	}
+
+	known := make(map[string]bool)
+	kept := c.Backups[:0]
+	for _, rec := range c.Backups {
+		if _, ok := onDisk[rec.File]; ok {
+			kept = append(kept, rec)
+			known[rec.File] = true
+		}
+	}
+	c.Backups = kept
+
+	for name, info := range onDisk {
+		if known[name] {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		rec := BackupRecord{
+			File:    name,
+			Time:    backupTimeFromName(name, info.ModTime()),
+			Size:    info.Size(),
+			Files:   countBackupFiles(path),
+			Trigger: triggerUnknown,
+		}
+		if !isSnapshotFile(name) {
+			rec.Base = readBackupBase(path)
+		}
+		c.Backups = append(c.Backups, rec)
+	}
+
+	sort.Slice(c.Backups, func(i, j int) bool {
+		return c.Backups[i].Time.Before(c.Backups[j].Time)
+	})
+	return nil
+}
+
+// add 登記新備份
+func (c *backupCatalog) add(rec BackupRecord) {
+	c.remove(rec.File)
+	c.Backups = append(c.Backups, rec)
+	sort.Slice(c.Backups, func(i, j int) bool {
+		return c.Backups[i].Time.Before(c.Backups[j].Time)
+	})
+}
+
+// remove
+func (c *backupCatalog) remove(file string) {
+	kept := c.Backups[:0]
+	for _, rec := range c.Backups {
+		if rec.File != file {
+			kept = append(kept, rec)
+		}
+	}
+	c.Backups = kept
+}
+
+// listBackups 備份目錄 dir 中的備份 由舊到新
+func listBackups(dir string) ([]BackupRecord, error) {
+	var records []BackupRecord
+	err := updateCatalog(dir, func(c *backupCatalog) error {
+		if err := c.sync(dir); err != nil {
+			return err
+		}
+		records = append(records, c.Backups...)
+		return nil
+	})
+	return records, err
+}
+
+// recordBackup 登記剛完成的備份
+func recordBackup(dir string, rec BackupRecord) {
+	err := updateCatalog(dir, func(c *backupCatalog) error {
+		c.add(rec)
+		return nil
+	})
+	if err != nil {
+		log.Printf(I18n("catalog_update_failed"), err)
+	}
+}
+
+// setVerified 更新備份的驗證狀態
+func setVerified(dir, file, status string) {
+	err := updateCatalog(dir, func(c *backupCatalog) error {
+		if err := c.sync(dir); err != nil {
+			return err
+		}
+		for i := range c.Backups {
+			if c.Backups[i].File == file {
+				c.Backups[i].Verified = status
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf(I18n("catalog_update_failed"), err)
+	}
+}
+
+// setPinned 設定備份是否受保護 受保護的備份不會被自動清理
+func setPinned(dir, file string, pinned bool) error {
+	found := false
+	err := updateCatalog(dir, func(c *backupCatalog) error {
+		if err := c.sync(dir); err != nil {
+			return err
+		}
+		for i := range c.Backups {
+			if c.Backups[i].File == file {
+				c.Backups[i].Pinned = pinned
+				found = true
+			}
+		}
+		return nil
+	})
+	if err == nil && !found {
+		err = fmt.Errorf(I18n("restore_backup_not_found"), file)
+	}
+	return err
+}
+
+// forgetBackups 從 catalog 移除已刪除的備份
+func forgetBackups(dir string, files []string) {
+	if len(files) == 0 {
+		return
+	}
+	err := updateCatalog(dir, func(c *backupCatalog) error {
+		for _, file := range files {
+			c.remove(file)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf(I18n("catalog_update_failed"), err)
+	}
+}
+
+// isBackupFile
+func isBackupFile(name string) bool {
+	return strings.HasPrefix(name, "backup-") && archiveFormat(name) != ""
+}
+
+// catalogName 備份在 catalog 中的名稱 (相對備份目錄)
+func catalogName(dir, backupPath string) string {
+	rel, err := filepath.Rel(dir, backupPath)
+	if err != nil || !filepath.IsLocal(rel) {
+		return filepath.Base(backupPath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// backupDir 備份所在的備份目錄 (snapshot 位於 <dir>/repository/snapshots)
+func backupDir(backupPath string) string {
+	dir := filepath.Dir(backupPath)
+	if strings.HasSuffix(backupPath, ".json") {
+		dir = filepath.Dir(filepath.Dir(dir))
+	}
+	return dir
+}
+
+// backupTimeFromName 從檔名取得備份時間 無法解析時使用 fallback
+func backupTimeFromName(name string, fallback time.Time) time.Time {
+	stamp := strings.TrimPrefix(path.Base(name), "backup-")
+	if len(stamp) >= len(backupTimeFormat) {
+		if t, err := time.ParseInLocation(backupTimeFormat, stamp[:len(backupTimeFormat)], time.Local); err == nil {
+			return t
+		}
+	}
+	return fallback
+}
+
+// backupBaseName 備份檔名 (不含副檔名) 具名的 job 會加上名稱 有標籤時加上觸發來源與標籤
+func backupBaseName(job *BackupJob, startTime time.Time, request backupRequest) string {
+	name := "backup-" + startTime.Format(backupTimeFormat)
+	if job.Name != "" {
+		name += "-" + job.Name
+	}
+	if slug := labelSlug(request.label); slug != "" {
+		name += "-" + request.trigger + "-" + slug
+	}
+	return name
+}
+
+// 檔名中標籤的最大長度 (字元)
+const maxLabelSlugLength = 48
+
+// labelSlug 將標籤轉為可用於檔名的字串 保留文字與數字 其他字元以 _ 取代
+func labelSlug(label string) string {
+	var b strings.Builder
+	pending := false
+	for _, r := range label {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' {
+			if pending && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			pending = false
+			b.WriteRune(r)
+		} else {
+			pending = true
+		}
+	}
+	slug := []rune(strings.Trim(b.String(), ".-"))
+	if len(slug) > maxLabelSlugLength {
+		slug = slug[:maxLabelSlugLength]
+	}
+	return strings.Trim(string(slug), "._-")
+}
+
+// triggerDescription 觸發來源與觸發者 (例如 manual (alice))
+func (rec BackupRecord) triggerDescription() string {
+	if rec.By == "" {
+		return rec.Trigger
+	}
+	return fmt.Sprintf("%s (%s)", rec.Trigger, rec.By)
+}
+
+// countBackupFiles
+func countBackupFiles(path string) int {
+	source, err := openBackup(path)
+	if err != nil {
+		return 0
+	}
+	defer source.Close()
+	return len(source.entries())
+}
+
+// runBackupsCommand backups <list|verify|prune|pin|unpin>
+func runBackupsCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(I18n("backups_usage"))
+	}
+	switch args[0] {
+	case "list":
+		return printBackupList()
+	case "verify":
+		return runVerifyCommand(args[1:])
+	case "prune":
+		return runPruneCommand(args[1:])
+	case "pin":
+		return runPinCommand(args[1:], true)
+	case "unpin":
+		return runPinCommand(args[1:], false)
+	default:
+		return errors.New(I18n("backups_usage"))
+	}
+}
+
+// runPinCommand backups pin|unpin <archive>
+func runPinCommand(args []string, pinned bool) error {
+	if len(args) != 1 {
+		return errors.New(I18n("backups_usage"))
+	}
+	path, err := resolveBackup(args[0])
+	if err != nil {
+		return err
+	}
+	dir := backupDir(path)
+	name := catalogName(dir, path)
+	if err := setPinned(dir, name, pinned); err != nil {
+		return err
+	}
+	if pinned {
+		log.Printf(I18n("backup_pinned"), name)
+	} else {
+		log.Printf(I18n("backup_unpinned"), name)
+	}
+	return nil
+}
+
+// printBackupList 依備份目錄列出所有備份
+func printBackupList() error {
+	dirs := backupDestinations()
+	for _, dir := range dirs {
+		records, err := listBackups(dir)
+		if err != nil {
+			return err
+		}
+		if len(dirs) > 1 {
+			log.Printf(I18n("backup_directory_is"), dir)
+		}
+		if len(records) == 0 {
+			log.Println(I18n("restore_no_backups"))
+			continue
+		}
+
+		queue := loadReplicationQueue(dir)
+		w := tabwriter.NewWriter(log.Writer(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, I18n("backups_list_header"))
+		var totalSize int64
+		for _, rec := range records {
+			totalSize += rec.Size
+			verified := rec.Verified
+			if verified == "" {
+				verified = "-"
+			}
+			job := rec.Job
+			if job == "" {
+				job = "-"
+			}
+			pinned := "-"
+			if rec.Pinned {
+				pinned = "pinned"
+			}
+			label := rec.Label
+			if label == "" {
+				label = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%.2f MB\t%d\t%v\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				rec.Time.Format("2006-01-02 15:04:05"), rec.File, float64(rec.Size)/1024/1024,
+				rec.Files, rec.Duration.Round(time.Second), job, rec.triggerDescription(), verified, pinned, label,
+				replicationStatus(rec, queue))
+		}
+		w.Flush()
+		log.Printf(I18n("backups_list_total"), len(records), float64(totalSize)/1e9)
+	}
+	return nil
+}
\ No newline at end of file
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+)
+
+// runCommand 命令列子指令 (mc-manager <command> ...)
+func runCommand(args []string) error {
+	switch args[0] {
+	case "restore":
+		return runRestoreCommand(args[1:])
+	case "backups":
+		return runBackupsCommand(args[1:])
+	default:
+		return fmt.Errorf(I18n("cli_unknown_command"), args[0])
+	}
+}
+
+// parseFlags 解析 flag 並回傳位置參數 flag 可以出現在任意位置
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.SetOutput(log.Writer())
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
\ No newline at end of file
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// 伺服器存檔完成時輸出的訊息
+const savedGameMessage = "Saved the game"
+
+// savedGamePattern 只比對伺服器本身的日誌行 (例如 "[12:00:00] [Server thread/INFO]: Saved the game")
+// 訊息必須緊接在行首的 [...] 標頭之後 玩家聊天 ("<player> ...") 與 /say ("[player] ...") 不符合
+var savedGamePattern = regexp.MustCompile(`^(\[[^\]]*\] ?)+: ` + regexp.QuoteMeta(savedGameMessage) + `\s*$`)
+
+var errServerNotRunning = errors.New("server is not running")
+
+// errServerHeld restore 進行中 不啟動伺服器
+var errServerHeld = errors.New("server is held by a restore")
+
+// console 目前運行中伺服器的 stdin
+var console serverConsole
+
+type serverConsole struct {
+	mu     sync.Mutex
+	stdin  io.Writer
+	stop   context.CancelFunc
+	exited chan struct{}
+	hold   chan struct{}
+}
+
+// start 未被 hold 時啟動伺服器 並綁定 stdin 與關閉函數
+// 與 stopAndHold 使用同一個鎖 restore 不會錯過剛啟動的伺服器
+func (c *serverConsole) start(cmd *exec.Cmd, stdin io.Writer, stop context.CancelFunc) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hold != nil {
+		return errServerHeld
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	c.stdin = stdin
+	c.stop = stop
+	c.exited = make(chan struct{})
+	return nil
+}
+
+// detach 伺服器退出後解除綁定
+func (c *serverConsole) detach() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stdin = nil
+	c.stop = nil
+	if c.exited != nil {
+		close(c.exited)
+		c.exited = nil
+	}
+}
+
+// stopAndHold 關閉伺服器 並在呼叫 release 前不再啟動
+func (c *serverConsole) stopAndHold() (release func()) {
+	hold := make(chan struct{})
+	c.mu.Lock()
+	c.hold = hold
+	stop, exited := c.stop, c.exited
+	c.mu.Unlock()
+
+	if stop != nil {
+		stop()
+		<-exited
+	}
+	return sync.OnceFunc(func() {
+		c.mu.Lock()
+		c.hold = nil
+		c.mu.Unlock()
+		close(hold)
+	})
+}
+
+// waitHold 伺服器被 hold 時阻塞到釋放 回傳是否曾被 hold
+func (c *serverConsole) waitHold(ctx context.Context) bool {
+	c.mu.Lock()
+	hold := c.hold
+	c.mu.Unlock()
+	if hold == nil {
+		return false
+	}
+	select {
+	case <-hold:
+	case <-ctx.Done():
+	}
+	return true
+}
+
+// running
+func (c *serverConsole) running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stdin != nil
+}
+
+// sendCommand 寫入一行指令到伺服器
+func (c *serverConsole) sendCommand(command string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stdin == nil {
+		return errServerNotRunning
+	}
+	_, err := io.WriteString(c.stdin, command+"\n")
+	return err
+}
+
+// suspendAutoSave save-off / save-all flush 並等待存檔完成 回傳恢復 save-on 的函數
+func suspendAutoSave() func() {
+	noop := func() {}
+	if !config.Backup.SaveControl {
+		return noop
+	}
+	if !console.running() {
+		log.Println(I18n("backup_save_control_server_not_running"))
+		return noop
+	}
+
+	saved, cancel := events.subscribe("saved", savedGamePattern)
+	defer cancel()
+
+	if err := console.sendCommand("save-off"); err != nil {
+		log.Printf(I18n("backup_save_control_command_failed"), "save-off", err)
+		return noop
+	}
+	resume := sync.OnceFunc(func() {
+		if err := console.sendCommand("save-on"); err != nil {
+			log.Printf(I18n("backup_save_control_command_failed"), "save-on", err)
+			return
+		}
+		log.Println(I18n("backup_save_control_resumed"))
+	})
+
+	if err := console.sendCommand("save-all flush"); err != nil {
+		log.Printf(I18n("backup_save_control_command_failed"), "save-all flush", err)
+		return resume
+	}
+
+	timeout := time.Duration(config.Backup.SaveTimeoutSeconds) * time.Second
+	select {
+	case <-saved:
+		log.Println(I18n("backup_save_control_saved"))
+	case <-time.After(timeout):
+		log.Printf(I18n("backup_save_control_timeout"), timeout)
+	}
+	return resume
+}
\ No newline at end of file
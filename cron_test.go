@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"0 0 * foo *",
+		"@every 30s",
+		"@every 0d",
+		"@every soon",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestParseCronAny(t *testing.T) {
+	tests := []struct {
+		expr           string
+		domAny, dowAny bool
+	}{
+		{"0 3 * * *", true, true},
+		{"0 3 ? * ?", true, true},
+		{"0 3 */1 * */1", true, true},
+		{"0 3 1-31 * 0-6", true, true},
+		{"0 3 1-31 * 1-7", true, true},
+		{"0 3 */2 * *", false, true},
+		{"0 3 1-30 * *", false, true},
+		{"0 3 * * 1-5", true, false},
+		{"0 3 13 * 5", false, false},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		if s.domAny != tt.domAny || s.dowAny != tt.dowAny {
+			t.Errorf("parseCron(%q): domAny=%v dowAny=%v, expected %v %v", tt.expr, s.domAny, s.dowAny, tt.domAny, tt.dowAny)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	// 2026-10-16 是星期五
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"every six hours", "0 */6 * * *", utc(2026, 10, 16, 7, 15), utc(2026, 10, 16, 12, 0)},
+		{"exact minute is skipped", "0 12 * * *", utc(2026, 10, 16, 12, 0), utc(2026, 10, 17, 12, 0)},
+		{"daily", "@daily", utc(2026, 10, 16, 12, 0), utc(2026, 10, 17, 0, 0)},
+		{"hourly", "@HOURLY", utc(2026, 10, 16, 12, 59), utc(2026, 10, 16, 13, 0)},
+		{"weekly", "@weekly", utc(2026, 10, 16, 12, 0), utc(2026, 10, 18, 0, 0)},
+		{"every minutes", "@every 90m", time.Date(2026, 10, 16, 12, 0, 30, 0, time.UTC), time.Date(2026, 10, 16, 13, 30, 30, 0, time.UTC)},
+		{"every days", "@every 2d", utc(2026, 10, 16, 12, 0), utc(2026, 10, 18, 12, 0)},
+		{"list and range", "15,45 9-17 * * *", utc(2026, 10, 16, 17, 50), utc(2026, 10, 17, 9, 15)},
+		{"range with step", "0 8-20/6 * * *", utc(2026, 10, 16, 15, 0), utc(2026, 10, 16, 20, 0)},
+		{"day of month", "0 3 15 * *", utc(2026, 10, 16, 0, 0), utc(2026, 11, 15, 3, 0)},
+		{"month names", "30 4 1 jan,jul *", utc(2026, 10, 16, 0, 0), utc(2027, 1, 1, 4, 30)},
+		{"leap day", "0 0 29 2 *", utc(2026, 3, 1, 0, 0), utc(2028, 2, 29, 0, 0)},
+		{"never", "0 0 30 2 *", utc(2026, 10, 16, 0, 0), time.Time{}},
+
+		// 星期
+		{"weekday", "0 3 * * 1", utc(2026, 10, 16, 4, 0), utc(2026, 10, 19, 3, 0)},
+		{"weekday name", "0 3 * * MON", utc(2026, 10, 16, 4, 0), utc(2026, 10, 19, 3, 0)},
+		{"sunday as 7", "0 0 * * 7", utc(2026, 10, 16, 4, 0), utc(2026, 10, 18, 0, 0)},
+		{"weekdays range", "0 3 * * mon-fri", utc(2026, 10, 16, 4, 0), utc(2026, 10, 19, 3, 0)},
+
+		// 日與星期都有限制時符合其一即可
+		{"dom or dow: friday first", "0 3 13 * 5", utc(2026, 10, 16, 4, 0), utc(2026, 10, 23, 3, 0)},
+		{"dom or dow: 13th on a sunday", "0 3 13 * 5", utc(2026, 12, 12, 4, 0), utc(2026, 12, 13, 3, 0)},
+		{"full-range dom step is any", "0 3 */1 * 1", utc(2026, 10, 16, 4, 0), utc(2026, 10, 19, 3, 0)},
+		{"full-range dom list is any", "0 3 1-31 * 1", utc(2026, 10, 16, 4, 0), utc(2026, 10, 19, 3, 0)},
+		{"partial dom step is not any", "0 3 */2 * 1", utc(2026, 10, 16, 4, 0), utc(2026, 10, 17, 3, 0)},
+		{"full-range dow is any", "0 3 15 * */1", utc(2026, 10, 16, 4, 0), utc(2026, 11, 15, 3, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			if got := s.next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("next(%q, %v) = %v, expected %v", tt.expr, tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 智利在午夜切換夏令時間 2026-09-06 00:00 直接跳到 01:00
+	santiago, err := time.LoadLocation("America/Santiago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(loc *time.Location, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, loc)
+	}
+	// 2026-11-01 01:30 出現兩次 time.Date 回傳第一次 (EDT)
+	firstOneThirty := at(newYork, 11, 1, 1, 30)
+	secondOneThirty := firstOneThirty.Add(time.Hour)
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want []time.Time
+	}{
+		{"spring forward skips the missing hour", "30 2 * * *", at(newYork, 3, 8, 0, 0),
+			[]time.Time{at(newYork, 3, 9, 2, 30), at(newYork, 3, 10, 2, 30)}},
+		{"spring forward hourly", "0 * * * *", at(newYork, 3, 8, 1, 30),
+			[]time.Time{at(newYork, 3, 8, 3, 0), at(newYork, 3, 8, 4, 0)}},
+		{"spring forward every", "@every 1h", at(newYork, 3, 8, 1, 30),
+			[]time.Time{at(newYork, 3, 8, 3, 30), at(newYork, 3, 8, 4, 30)}},
+		{"fall back runs in both hours", "30 1 * * *", at(newYork, 11, 1, 0, 0),
+			[]time.Time{firstOneThirty, secondOneThirty, at(newYork, 11, 2, 1, 30)}},
+		{"fall back half-hourly", "*/30 * * * *", at(newYork, 11, 1, 1, 45),
+			[]time.Time{firstOneThirty.Add(30 * time.Minute), secondOneThirty, secondOneThirty.Add(30 * time.Minute)}},
+		{"midnight gap", "0 0 * * *", at(santiago, 9, 5, 12, 0),
+			[]time.Time{at(santiago, 9, 7, 0, 0)}},
+		{"after midnight gap", "0 3 * * *", at(santiago, 9, 5, 12, 0),
+			[]time.Time{at(santiago, 9, 6, 3, 0), at(santiago, 9, 7, 3, 0)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			from := tt.from
+			for _, want := range tt.want {
+				got := s.next(from)
+				if !got.Equal(want) {
+					t.Fatalf("next(%q, %v) = %v, expected %v", tt.expr, from, got, want)
+				}
+				from = got
+			}
+		})
+	}
+}
\ No newline at end of file
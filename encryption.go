@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// 加密的備份檔在格式的副檔名後加上 .age 可以用 age 工具解密
+const encryptedSuffix = ".age"
+
+// sessionIdentity 只設定公鑰時 每個備份額外加密給這把只存在記憶體中的金鑰 讓備份完成後的驗證可以解密
+// 重新啟動後就無法再使用 之前的備份仍需要 identity_file
+var sessionIdentity *age.X25519Identity
+
+// errNoIdentity 備份已加密 但沒有可以解密的金鑰
+var errNoIdentity = errors.New("backup is encrypted, but neither identity_file nor passphrase_env is set")
+
+// BackupEncryption [backup.encryption] 壓縮後再以 age 加密
+type BackupEncryption struct {
+	Recipients    []string `toml:"recipients"`     // X25519 公鑰 (age1...)
+	PassphraseEnv string   `toml:"passphrase_env"` // 以環境變數中的密碼加密 不可與 recipients 同時使用
+	IdentityFile  string   `toml:"identity_file"`  // restore / verify 解密用的私鑰檔 (AGE-SECRET-KEY-1...)
+
+	recipients []age.Recipient
+}
+
+// normalizeBackupEncryption 檢查加密設定並解析公鑰
+func normalizeBackupEncryption(workDir string) error {
+	enc := &config.Backup.Encryption
+	enc.recipients = nil
+	for _, s := range enc.Recipients {
+		recipient, err := age.ParseX25519Recipient(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf(I18n("config_backup_encryption_invalid"), err)
+		}
+		enc.recipients = append(enc.recipients, recipient)
+	}
+	if enc.PassphraseEnv != "" {
+		// age 的密碼加密只能單獨使用
+		if len(enc.recipients) > 0 {
+			return fmt.Errorf(I18n("config_backup_encryption_invalid"), "recipients and passphrase_env cannot be used together")
+		}
+		passphrase := os.Getenv(enc.PassphraseEnv)
+		if passphrase == "" {
+			return fmt.Errorf(I18n("config_backup_encryption_invalid"), "environment variable "+enc.PassphraseEnv+" is empty")
+		}
+		recipient, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return fmt.Errorf(I18n("config_backup_encryption_invalid"), err)
+		}
+		enc.recipients = append(enc.recipients, recipient)
+	}
+	if enc.IdentityFile != "" && !filepath.IsAbs(enc.IdentityFile) {
+		enc.IdentityFile = filepath.Join(workDir, enc.IdentityFile)
+	}
+	if enc.enabled() && config.Backup.Mode == backupModeRepository {
+		return fmt.Errorf(I18n("config_backup_encryption_invalid"), "mode = \"repository\" cannot be encrypted")
+	}
+
+	sessionIdentity = nil
+	if len(enc.Recipients) > 0 && enc.IdentityFile == "" {
+		// 增量備份需要讀取上一個備份的 manifest
+		if config.Backup.Mode == backupModeIncremental {
+			return fmt.Errorf(I18n("config_backup_encryption_invalid"), "mode = \"incremental\" needs identity_file to read the previous backup")
+		}
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			return fmt.Errorf(I18n("config_backup_encryption_invalid"), err)
+		}
+		sessionIdentity = identity
+	}
+	return nil
+}
+
+// enabled 新的備份是否加密
+func (e *BackupEncryption) enabled() bool {
+	return len(e.recipients) > 0
+}
+
+// archiveExtension 新備份檔的副檔名
+func archiveExtension(format string) string {
+	if config.Backup.Encryption.enabled() {
+		return "." + format + encryptedSuffix
+	}
+	return "." + format
+}
+
+// isEncrypted
+func isEncrypted(path string) bool {
+	return strings.HasSuffix(path, encryptedSuffix)
+}
+
+// encryptWriter 未設定加密時回傳 nil
+func encryptWriter(out io.Writer) (io.WriteCloser, error) {
+	if !config.Backup.Encryption.enabled() {
+		return nil, nil
+	}
+	recipients := config.Backup.Encryption.recipients
+	if sessionIdentity != nil {
+		recipients = append(slices.Clip(recipients), sessionIdentity.Recipient())
+	}
+	return age.Encrypt(out, recipients...)
+}
+
+// backupIdentities 解密用的金鑰 來自 identity_file 與 passphrase_env
+func backupIdentities() ([]age.Identity, error) {
+	enc := &config.Backup.Encryption
+	var identities []age.Identity
+	if enc.IdentityFile != "" {
+		f, err := os.Open(enc.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		parsed, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("identity_file %s: %w", enc.IdentityFile, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	if enc.PassphraseEnv != "" {
+		if passphrase := os.Getenv(enc.PassphraseEnv); passphrase != "" {
+			identity, err := age.NewScryptIdentity(passphrase)
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, identity)
+		}
+	}
+	if sessionIdentity != nil {
+		identities = append(identities, sessionIdentity)
+	}
+	if len(identities) == 0 {
+		return nil, errNoIdentity
+	}
+	return identities, nil
+}
+
+// openArchiveFile 開啟備份檔 加密的備份邊讀邊解密
+func openArchiveFile(path string) (io.Reader, *os.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isEncrypted(path) {
+		return file, file, nil
+	}
+	identities, err := backupIdentities()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	decrypted, err := age.Decrypt(file, identities...)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf(I18n("backup_decrypt_failed"), filepath.Base(path), err)
+	}
+	return decrypted, file, nil
+}
+
+// 解密 zip 時的暫存檔名稱 與備份檔位於同一個目錄
+const decryptTempPattern = "decrypt-*" + partialSuffix
+
+// openZipArchive zip 需要隨機讀取 加密的 zip 先解密到備份目錄中只有自己可讀的暫存檔 關閉時刪除
+func openZipArchive(path string) (*zip.Reader, io.Closer, error) {
+	if !isEncrypted(path) {
+		zipReader, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &zipReader.Reader, zipReader, nil
+	}
+
+	decrypted, file, err := openArchiveFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	// CreateTemp 建立的檔案權限為 0600
+	tmp, err := os.CreateTemp(filepath.Dir(path), decryptTempPattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 開啟中就先刪除 崩潰時不會留下明文 Windows 無法刪除開啟中的檔案 改為關閉後刪除
+	// 崩潰時留下的暫存檔由 cleanupPartialBackups 清理
+	removed := os.Remove(tmp.Name()) == nil
+	remove := closerFunc(func() error {
+		err := tmp.Close()
+		if !removed {
+			err = os.Remove(tmp.Name())
+		}
+		return err
+	})
+	size, err := io.Copy(tmp, decrypted)
+	if err != nil {
+		remove.Close()
+		return nil, nil, fmt.Errorf(I18n("backup_decrypt_failed"), filepath.Base(path), err)
+	}
+	zipReader, err := zip.NewReader(tmp, size)
+	if err != nil {
+		remove.Close()
+		return nil, nil, err
+	}
+	return zipReader, remove, nil
+}
\ No newline at end of file
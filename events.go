@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// events 伺服器輸出事件匯流排
+var events eventBus
+
+// serverLogger 伺服器輸出寫入 manager.log
+var serverLogger *log.Logger
+
+// ServerEvent 一行伺服器輸出與匹配結果
+type ServerEvent struct {
+	Kind   string
+	Line   string
+	Fields map[string]string
+}
+
+type subscription struct {
+	kind    string
+	pattern *regexp.Regexp
+	ch      chan ServerEvent
+}
+
+type eventBus struct {
+	mu       sync.RWMutex
+	subs     map[*subscription]struct{}
+	patterns map[string]*regexp.Regexp
+}
+
+// setPatterns 設定具名事件 (chat, join, leave...) 的 regex
+func (b *eventBus) setPatterns(patterns map[string]*regexp.Regexp) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.patterns = patterns
+}
+
+// subscribe 訂閱匹配 pattern 的輸出行 呼叫 cancel 取消訂閱
+func (b *eventBus) subscribe(kind string, pattern *regexp.Regexp) (<-chan ServerEvent, func()) {
+	sub := &subscription{kind: kind, pattern: pattern, ch: make(chan ServerEvent, 64)}
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[*subscription]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	cancel := func() {
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+	}
+	return sub.ch, cancel
+}
+
+// subscribeKind 使用 [discord.patterns] 中的具名 regex 訂閱 未設定時回傳 false
+func (b *eventBus) subscribeKind(kind string) (<-chan ServerEvent, func(), bool) {
+	b.mu.RLock()
+	pattern, ok := b.patterns[kind]
+	b.mu.RUnlock()
+	if !ok {
+		return nil, nil, false
+	}
+	ch, cancel := b.subscribe(kind, pattern)
+	return ch, cancel, true
+}
+
+// publish 分發一行輸出 訂閱者處理不及時丟棄 不阻塞伺服器輸出
+func (b *eventBus) publish(line string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		match := sub.pattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		event := ServerEvent{Kind: sub.kind, Line: line, Fields: make(map[string]string)}
+		for i, name := range sub.pattern.SubexpNames() {
+			if i > 0 && name != "" {
+				event.Fields[name] = match[i]
+			}
+		}
+		select {
+		case sub.ch <- event:
+		default:
+		}
+	}
+}
+
+// outputWriter 轉發伺服器輸出到終端 並逐行寫入日誌與事件匯流排
+type outputWriter struct {
+	out io.Writer
+	buf []byte
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.out.Write(p)
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.buf[:i])
+		w.buf = w.buf[i+1:]
+		w.publish(line)
+	}
+	return len(p), nil
+}
+
+// Close 伺服器結束後送出最後一行沒有換行的輸出 (例如崩潰前的最後訊息)
+func (w *outputWriter) Close() error {
+	if len(w.buf) > 0 {
+		line := string(w.buf)
+		w.buf = nil
+		w.publish(line)
+	}
+	return nil
+}
+
+// publish 寫入日誌與事件匯流排
+func (w *outputWriter) publish(line string) {
+	line = strings.TrimRight(line, "\r")
+	if serverLogger != nil {
+		serverLogger.Println(line)
+	}
+	events.publish(line)
+}
+
+// compileEventPatterns 編譯 [discord.patterns] 無效的 regex 只顯示警告並略過
+func compileEventPatterns() map[string]*regexp.Regexp {
+	p := config.Discord.Patterns
+	sources := map[string]string{
+		"chat":        p.Chat,
+		"join":        p.Join,
+		"leave":       p.Leave,
+		"death":       p.Death,
+		"advancement": p.Advancement,
+	}
+	patterns := make(map[string]*regexp.Regexp)
+	for kind, src := range sources {
+		if src == "" {
+			continue
+		}
+		re, err := regexp.Compile(src)
+		if err != nil {
+			log.Printf(I18n("config_pattern_invalid"), kind, err)
+			continue
+		}
+		patterns[kind] = re
+	}
+	return patterns
+}
\ No newline at end of file
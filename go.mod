@@ -2,11 +2,18 @@ module mc-manager
 
 go 1.25.0
 
-require github.com/BurntSushi/toml v1.5.0
+require (
+	filippo.io/age v1.2.1
+	github.com/BurntSushi/toml v1.5.0
+	github.com/Xuanwo/go-locale v1.1.3
+	github.com/klauspost/compress v1.20.1
+	github.com/nicksnyder/go-i18n/v2 v2.6.0
+	github.com/pkg/sftp v1.13.10
+	golang.org/x/crypto v0.45.0
+	golang.org/x/text v0.31.0
+)
 
 require (
-	github.com/Xuanwo/go-locale v1.1.3 // indirect
-	github.com/nicksnyder/go-i18n/v2 v2.6.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
-	golang.org/x/text v0.28.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
 )
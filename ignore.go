@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 備份來源根目錄中可選的排除規則檔
+const backupIgnoreFileName = ".backupignore"
+
+// excludeRule 一條 gitignore 風格的排除規則
+type excludeRule struct {
+	base     string   // 規則相對的目錄
+	segments []string // 以 / 分割的 pattern ** 代表任意層目錄
+	negate   bool     // ! 開頭 重新包含符合的檔案
+	dirOnly  bool     // / 結尾 只比對資料夾
+}
+
+// excludeRules 依序比對 最後符合的規則決定結果
+type excludeRules []excludeRule
+
+// parseExcludeRule 解析一行規則 空行與註解回傳 nil
+func parseExcludeRule(base, line string) (*excludeRule, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	rule := &excludeRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	line = filepath.ToSlash(line)
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	// 不含 / 的規則比對任意層的名稱 否則相對 base
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	line = strings.TrimPrefix(line, "/")
+	rule.segments = strings.Split(line, "/")
+	for _, segment := range rule.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+// loadExcludeRules config 中的 exclusions 加上來源根目錄的 .backupignore
+func loadExcludeRules(sourcePath string, exclusions []string) excludeRules {
+	workDir := mustGetwd()
+	var rules excludeRules
+	for _, line := range exclusions {
+		// 設定檔載入時已檢查過
+		if rule, err := parseExcludeRule(workDir, line); err == nil && rule != nil {
+			rules = append(rules, *rule)
+		}
+	}
+
+	if info, err := os.Stat(sourcePath); err != nil || !info.IsDir() {
+		return rules
+	}
+	ignorePath := filepath.Join(sourcePath, backupIgnoreFileName)
+	data, err := os.ReadFile(ignorePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf(I18n("backup_ignore_read_failed"), ignorePath, err)
+		}
+		return rules
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		rule, err := parseExcludeRule(sourcePath, line)
+		if err != nil {
+			log.Printf(I18n("backup_ignore_rule_invalid"), ignorePath, i+1, err)
+			continue
+		}
+		if rule != nil {
+			rules = append(rules, *rule)
+		}
+	}
+	return rules
+}
+
+// excluded path 是否被排除
+func (r excludeRules) excluded(filePath string, isDir bool) bool {
+	excluded := false
+	for _, rule := range r {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(rule.base, filePath)
+		if err != nil || rel == "." {
+			continue
+		}
+		if matchSegments(rule.segments, strings.Split(filepath.ToSlash(rel), "/")) {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
+
+// matchSegments 逐層比對路徑 ** 符合零或多層
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				// 結尾的 ** 只符合其下的內容
+				return len(name) > 0
+			}
+			for i := range name {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// validateExclusions 檢查設定檔中的排除規則
+func validateExclusions(exclusions []string) error {
+	for _, line := range exclusions {
+		if _, err := parseExcludeRule("", line); err != nil {
+			return fmt.Errorf(I18n("config_exclusion_invalid"), line, err)
+		}
+	}
+	return nil
+}
\ No newline at end of file
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// createIncrementalBackup 只備份上次備份後變更的檔案 每 full_every 次建立一次完整備份
+func createIncrementalBackup(job *BackupJob, request backupRequest, startTime time.Time, files []string) (*backupResult, error) {
+	base, state := incrementalBase(job)
+	if base == "" {
+		log.Println(I18n("backup_incremental_full"))
+		return createArchiveBackup(job, request, startTime, files)
+	}
+
+	manifest := newManifest()
+	manifest.Base = base
+	var changed []string
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			changed = append(changed, path)
+			continue
+		}
+		prev, ok := state[archiveEntryName(path)]
+		if ok && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) {
+			manifest.Unchanged = append(manifest.Unchanged, prev)
+			continue
+		}
+		changed = append(changed, path)
+	}
+	log.Printf(I18n("backup_incremental_changes"), len(changed), len(manifest.Unchanged), base)
+
+	backupFilename := backupBaseName(job, startTime, request) + "-incr" + archiveExtension(job.Format)
+	return writeArchiveBackup(job, backupFilename, changed, manifest)
+}
+
+// incrementalBase 找出同一個 job 增量備份的基準 需要完整備份時回傳空字串
+func incrementalBase(job *BackupJob) (string, map[string]ManifestFile) {
+	records, err := listBackups(job.Destination)
+	if err != nil {
+		log.Printf(I18n("backup_dir_get_failed"), err)
+		return "", nil
+	}
+
+	var prev *BackupRecord
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Job == job.Name && !isSnapshotFile(records[i].File) && records[i].Verified != verifyBad {
+			prev = &records[i]
+			break
+		}
+	}
+	if prev == nil {
+		return "", nil
+	}
+
+	// 距離上次完整備份的次數
+	byName := make(map[string]BackupRecord)
+	for _, rec := range records {
+		byName[rec.File] = rec
+	}
+	depth := 0
+	for rec := *prev; rec.Base != ""; depth++ {
+		next, ok := byName[rec.Base]
+		if !ok {
+			return "", nil
+		}
+		rec = next
+	}
+	if depth+1 >= config.Backup.FullEvery {
+		return "", nil
+	}
+
+	manifest, err := readArchiveManifest(filepath.Join(job.Destination, filepath.FromSlash(prev.File)))
+	if err == nil && manifest == nil {
+		err = fmt.Errorf("%s: %w", manifestFileName, os.ErrNotExist)
+	}
+	if err != nil {
+		log.Printf(I18n("backup_incremental_base_unreadable"), prev.File, err)
+		return "", nil
+	}
+
+	state := make(map[string]ManifestFile)
+	for _, f := range manifest.Files {
+		state[f.Path] = f
+	}
+	for _, f := range manifest.Unchanged {
+		state[f.Path] = f
+	}
+	return prev.File, state
+}
+
+// requiredBases 仍被 records 中的增量備份依賴的備份
+func requiredBases(all, records []BackupRecord) map[string]bool {
+	byName := make(map[string]BackupRecord)
+	for _, rec := range all {
+		byName[rec.File] = rec
+	}
+	required := make(map[string]bool)
+	for _, rec := range records {
+		for rec.Base != "" && !required[rec.Base] {
+			required[rec.Base] = true
+			next, ok := byName[rec.Base]
+			if !ok {
+				break
+			}
+			rec = next
+		}
+	}
+	return required
+}
+
+// readBackupBase 讀取備份檔 manifest 中的基準備份
+func readBackupBase(path string) string {
+	manifest, err := readArchiveManifest(path)
+	if err != nil || manifest == nil {
+		return ""
+	}
+	return manifest.Base
+}
+
+// incrementalSource 增量備份 未變更的檔案從基準備份讀取
+type incrementalSource struct {
+	own       backupSource
+	base      backupSource
+	unchanged []ManifestFile
+}
+
+// openIncrementalSource 基準備份位於同一個備份目錄 dir
+func openIncrementalSource(own backupSource, manifest *Manifest, dir string) (*incrementalSource, error) {
+	base, err := openBackup(filepath.Join(dir, filepath.FromSlash(manifest.Base)))
+	if err != nil {
+		return nil, fmt.Errorf(I18n("backup_incremental_base_missing"), manifest.Base, err)
+	}
+	return &incrementalSource{own: own, base: base, unchanged: manifest.Unchanged}, nil
+}
+
+func (s *incrementalSource) entries() []backupEntry {
+	entries := s.own.entries()
+	for _, f := range s.unchanged {
+		entries = append(entries, backupEntry{Name: f.Path, Size: f.Size, Modified: f.ModTime})
+	}
+	return entries
+}
+
+func (s *incrementalSource) walk(fn func(entry backupEntry, reader io.Reader) error) error {
+	if err := s.own.walk(fn); err != nil {
+		return err
+	}
+	wanted := make(map[string]bool)
+	for _, f := range s.unchanged {
+		wanted[f.Path] = true
+	}
+	return s.base.walk(func(entry backupEntry, reader io.Reader) error {
+		if !wanted[entry.Name] {
+			return nil
+		}
+		return fn(entry, reader)
+	})
+}
+
+func (s *incrementalSource) Close() error {
+	return errors.Join(s.own.Close(), s.base.Close())
+}
\ No newline at end of file
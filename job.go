@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// BackupJob 一個備份排程 未設定的欄位沿用 [backup] 的設定
+type BackupJob struct {
+	Name        string   `toml:"name"`
+	Schedule    string   `toml:"schedule"`
+	Sources     []string `toml:"sources"`
+	Exclusions  []string `toml:"exclusions"`
+	Format      string   `toml:"format"`
+	Destination string   `toml:"destination"`
+
+	schedule *cronSchedule
+	running  sync.Mutex
+}
+
+// backupJobs 設定檔中的 [[backup.jobs]] 沒有設定時只有一個由 [backup] 組成的 job
+var backupJobs []*BackupJob
+
+// job 名稱會出現在備份檔名中
+var jobNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// displayName 記錄中顯示的名稱
+func (j *BackupJob) displayName() string {
+	if j.Name == "" {
+		return "default"
+	}
+	return j.Name
+}
+
+// normalizeBackupJobs 建立 backupJobs 並套用預設值
+func normalizeBackupJobs(workDir string) error {
+	backupJobs = nil
+	if len(config.Backup.Jobs) == 0 {
+		schedule := config.Backup.Schedule
+		if schedule == "" && config.Backup.Interval != "" {
+			// 舊版的 interval 無效時只停用排程備份
+			if _, err := parseCron("@every " + config.Backup.Interval); err != nil {
+				log.Printf(I18n("config_backup_interval_format_invalid"), config.Backup.Interval, err)
+			} else {
+				schedule = "@every " + config.Backup.Interval
+			}
+		}
+		backupJobs = append(backupJobs, &BackupJob{Schedule: schedule})
+	}
+	for i := range config.Backup.Jobs {
+		job := &config.Backup.Jobs[i]
+		if job.Name == "" {
+			job.Name = fmt.Sprintf("job%d", i+1)
+		}
+		backupJobs = append(backupJobs, job)
+	}
+
+	names := make(map[string]bool)
+	for _, job := range backupJobs {
+		if job.Name != "" && (!jobNamePattern.MatchString(job.Name) || names[job.Name]) {
+			return fmt.Errorf(I18n("config_backup_job_name_invalid"), job.Name)
+		}
+		names[job.Name] = true
+
+		if job.Schedule != "" {
+			schedule, err := parseCron(job.Schedule)
+			if err == nil && schedule.next(time.Now()).IsZero() {
+				err = errors.New("never runs")
+			}
+			if err != nil {
+				return fmt.Errorf(I18n("config_backup_schedule_invalid"), job.Schedule, job.displayName(), err)
+			}
+			job.schedule = schedule
+		}
+
+		if len(job.Sources) == 0 {
+			job.Sources = config.Backup.Sources
+		} else {
+			for i, src := range job.Sources {
+				if !filepath.IsAbs(src) {
+					job.Sources[i] = filepath.Join(workDir, src)
+				}
+			}
+		}
+		if job.Exclusions == nil {
+			job.Exclusions = config.Backup.Exclusions
+		} else if err := validateExclusions(job.Exclusions); err != nil {
+			return err
+		}
+		if job.Format == "" {
+			job.Format = config.Backup.Format
+		}
+		if !slices.Contains(archiveFormats, job.Format) {
+			return fmt.Errorf(I18n("config_backup_format_invalid"), job.Format)
+		}
+		if job.Destination == "" {
+			job.Destination = config.Backup.Destination
+		} else if !filepath.IsAbs(job.Destination) {
+			job.Destination = filepath.Join(workDir, job.Destination)
+		}
+		if err := os.MkdirAll(job.Destination, 0755); err != nil {
+			return fmt.Errorf(I18n("backup_dir_create_failed"), job.Destination, err)
+		}
+	}
+	return nil
+}
+
+// defaultJob 啟動時與 backup 指令使用的 job
+func defaultJob() *BackupJob {
+	return backupJobs[0]
+}
+
+// backupDestinations 所有 job 的備份目錄 (不重複)
+func backupDestinations() []string {
+	var dirs []string
+	for _, job := range backupJobs {
+		if !slices.Contains(dirs, job.Destination) {
+			dirs = append(dirs, job.Destination)
+		}
+	}
+	return dirs
+}
+
+// backupSources 所有 job 的備份來源 (不重複)
+func backupSources() []string {
+	var sources []string
+	for _, job := range backupJobs {
+		for _, src := range job.Sources {
+			if !slices.Contains(sources, src) {
+				sources = append(sources, src)
+			}
+		}
+	}
+	return sources
+}
\ No newline at end of file
@@ -1,18 +1,22 @@
 package main
 
 import (
-	"archive/zip"
 	"bufio"
 	"compress/flate"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
+	"os/user"
 	"os/signal"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
@@ -27,8 +31,22 @@ var (
 	config      Config
 	backupMutex sync.Mutex
 	logFile     *os.File
+	shutdown    context.CancelFunc
 )
 
+// 備份模式
+const (
+	backupModeFull        = "full"
+	backupModeRepository  = "repository"
+	backupModeIncremental = "incremental"
+)
+
+// 寫入中的備份檔副檔名 完成後才重新命名
+const partialSuffix = ".partial"
+
+// 伺服器收到 SIGTERM 後 等待多久才強制結束
+const killGracePeriod = 10 * time.Second
+
 // config.toml
 type Config struct {
 	General struct {
@@ -42,18 +60,33 @@ type Config struct {
 		ServerArgs          []string `toml:"server_args"`
 		AutoRestart         bool     `toml:"auto_restart"`
 		RestartDelaySeconds int      `toml:"restart_delay_seconds"`
+		StopTimeoutSeconds  int      `toml:"stop_timeout_seconds"`
 	} `toml:"server"`
 	Backup struct {
-		Enabled           bool     `toml:"enabled"`
-		Interval          string   `toml:"interval"`
-		ManagerCommands   []string `toml:"manager_commands"`
-		CompressionLevel  int      `toml:"compression_level"`
-		Sources           []string `toml:"sources"`
-		Exclusions        []string `toml:"exclusions"`
-		Destination       string   `toml:"destination"`
-		RetentionCount    int      `toml:"retention_count"`
-		MaxTotalSizeGB    int      `toml:"max_total_size_gb"`
-		Workers           int      `toml:"workers"`
+		Enabled            bool        `toml:"enabled"`
+		Interval           string      `toml:"interval"`
+		Schedule           string      `toml:"schedule"`
+		ManagerCommands    []string    `toml:"manager_commands"`
+		CompressionLevel   int         `toml:"compression_level"`
+		Sources            []string    `toml:"sources"`
+		Exclusions         []string    `toml:"exclusions"`
+		Destination        string      `toml:"destination"`
+		RetentionPolicy
+		MaxTotalSizeGB     int         `toml:"max_total_size_gb"`
+		MinFreeSpaceGB     float64     `toml:"min_free_space_gb"`
+		PruneForFreeSpace  bool        `toml:"prune_for_free_space"`
+		Workers            int         `toml:"workers"`
+		Mode               string      `toml:"mode"`
+		Format             string      `toml:"format"`
+		Store              []string    `toml:"store"`
+		AutoStore          bool        `toml:"auto_store"`
+		FullEvery          int         `toml:"full_every"`
+		VerifyAfterBackup  bool        `toml:"verify_after_backup"`
+		SaveControl        bool        `toml:"save_control"`
+		SaveTimeoutSeconds int         `toml:"save_timeout_seconds"`
+		Jobs               []BackupJob    `toml:"jobs"`
+		Remotes            []BackupRemote `toml:"remotes"`
+		Encryption         BackupEncryption `toml:"encryption"`
 	} `toml:"backup"`
 	Discord struct {
 		Enabled             bool     `toml:"enabled"`
@@ -106,14 +139,26 @@ func main() {
 	}
 	defer logFile.Close()
 
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Printf("ERROR: %v", err)
+			logFile.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
 	if config.General.WindowTitle != "" {
 		exec.Command("cmd", "/c", "title", config.General.WindowTitle).Run()
 	}
 
 	log.Println("Minecraft Server Manager v1.9 by yuni_sakana")
-	log.Printf(I18n("backup_directory_is"), config.Backup.Destination)
+	for _, dir := range backupDestinations() {
+		log.Printf(I18n("backup_directory_is"), dir)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
+	shutdown = cancel
 	var wg sync.WaitGroup
 
 	go func() {
@@ -121,7 +166,7 @@ func main() {
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		<-sigChan
 		log.Println(I18n("manager_shutdown"))
-		cancel()
+		shutdown()
 	}()
 
 	wg.Add(1)
@@ -137,8 +182,19 @@ func main() {
 func runServerManager(ctx context.Context) {
 	workDir := mustGetwd()
 
+	for _, dir := range backupDestinations() {
+		cleanupPartialBackups(dir)
+	}
+
 	if config.Backup.Enabled {
-		runBackup()
+		runBackup(defaultJob(), backupRequest{trigger: triggerStartup})
+	}
+
+	go proxyConsoleInput(ctx)
+
+	if len(backupRemotes) > 0 {
+		// 上傳中關閉時不等待 佇列保存在磁碟上 下次啟動繼續
+		go runReplicationWorker(ctx)
 	}
 
 	var backupWg sync.WaitGroup
@@ -158,22 +214,35 @@ func runServerManager(ctx context.Context) {
 		default:
 		}
 
+		console.waitHold(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+
 		log.Println(I18n("server_starting"))
 
 		allArgs := []string{}
 		allArgs = append(allArgs, config.Server.JvmArgs...)
 		allArgs = append(allArgs, config.Server.ServerArgs...)
 
-		cmd := exec.CommandContext(ctx, config.Server.JavaPath, allArgs...)
+		cmd := exec.Command(config.Server.JavaPath, allArgs...)
 		cmd.Dir = workDir
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		isolateProcess(cmd)
+		stdout, stderr := &outputWriter{out: os.Stdout}, &outputWriter{out: os.Stderr}
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
 
 		serverStdin, err := cmd.StdinPipe()
 		if err != nil {
 		}
 
-		if err := cmd.Start(); err != nil {
+		runCtx, stopRun := context.WithCancel(ctx)
+		if err := console.start(cmd, serverStdin, stopRun); err != nil {
+			stopRun()
+			serverStdin.Close()
+			if errors.Is(err, errServerHeld) {
+				continue
+			}
 			log.Printf(I18n("error_start_server_failed"), err)
 			if !config.Server.AutoRestart {
 				break
@@ -181,9 +250,12 @@ func runServerManager(ctx context.Context) {
 			goto RESTART_DELAY
 		}
 
-		go proxyConsoleInput(ctx, serverStdin)
-
-		if err := cmd.Wait(); err != nil {
+		err = waitServer(runCtx, cmd)
+		stopRun()
+		// cmd.Wait 已等待輸出複製完成
+		stdout.Close()
+		stderr.Close()
+		if err != nil {
 			if ctx.Err() == context.Canceled {
 				log.Println(I18n("server_process_terminated"))
 			} else {
@@ -195,6 +267,9 @@ func runServerManager(ctx context.Context) {
 
 		serverStdin.Close()
 
+		if console.waitHold(ctx) {
+			continue
+		}
 		if !config.Server.AutoRestart {
 			log.Println(I18n("server_auto_restart_disabled"))
 			break
@@ -214,8 +289,53 @@ func runServerManager(ctx context.Context) {
 	backupWg.Wait()
 }
 
+// waitServer 等待 console.start 啟動的伺服器結束 ctx 取消 (關閉管理器或 restore 要求) 時優雅關閉
+func waitServer(ctx context.Context, cmd *exec.Cmd) error {
+	defer console.detach()
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			stopServer(cmd, exited)
+		case <-exited:
+		}
+	}()
+
+	err := cmd.Wait()
+	close(exited)
+	return err
+}
+
+// stopServer 送出 stop 等待伺服器自行關閉 逾時後依序 SIGTERM / SIGKILL
+func stopServer(cmd *exec.Cmd, exited <-chan struct{}) {
+	timeout := time.Duration(config.Server.StopTimeoutSeconds) * time.Second
+	log.Printf(I18n("server_stopping"), timeout)
+	if err := console.sendCommand("stop"); err != nil {
+		log.Printf(I18n("server_stop_command_failed"), err)
+	} else {
+		select {
+		case <-exited:
+			return
+		case <-time.After(timeout):
+		}
+	}
+
+	log.Println(I18n("server_stop_timeout_terminating"))
+	if err := cmd.Process.Signal(syscall.SIGTERM); err == nil {
+		select {
+		case <-exited:
+			return
+		case <-time.After(killGracePeriod):
+		}
+	}
+
+	log.Println(I18n("server_stop_timeout_killing"))
+	cmd.Process.Kill()
+}
+
 // proxyConsoleInput
-func proxyConsoleInput(ctx context.Context, serverStdin io.WriteCloser) {
+func proxyConsoleInput(ctx context.Context) {
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		select {
@@ -224,17 +344,19 @@ func proxyConsoleInput(ctx context.Context, serverStdin io.WriteCloser) {
 		default:
 			line := scanner.Text()
 			isManagerCmd := false
-			for _, cmd := range config.Backup.ManagerCommands {
-				if strings.ToLower(line) == cmd {
-					isManagerCmd = true
-					break
+			if fields := strings.Fields(line); len(fields) > 0 {
+				for _, cmd := range config.Backup.ManagerCommands {
+					if strings.ToLower(fields[0]) == cmd {
+						isManagerCmd = true
+						break
+					}
 				}
 			}
 
 			if isManagerCmd {
 				handleManagerCommand(line)
 			} else {
-				if _, err := io.WriteString(serverStdin, line+"\n"); err != nil {
+				if err := console.sendCommand(line); err != nil && !errors.Is(err, errServerNotRunning) {
 					return
 				}
 			}
@@ -244,55 +366,129 @@ func proxyConsoleInput(ctx context.Context, serverStdin io.WriteCloser) {
 
 // handleManagerCommand
 func handleManagerCommand(command string) {
-	switch strings.ToLower(command) {
+	fields := strings.Fields(command)
+	switch strings.ToLower(fields[0]) {
 	case "backup":
-		go runBackup()
+		request := backupRequest{trigger: triggerManual, by: consoleUser()}
+		labelFields := fields[1:]
+		if len(fields) > 1 && strings.ToLower(fields[1]) == "pin" {
+			request.pinned = true
+			labelFields = fields[2:]
+			if len(labelFields) == 0 {
+				log.Println(I18n("backup_pin_usage"))
+				return
+			}
+		}
+		request.label = strings.Join(labelFields, " ")
+		go runBackup(defaultJob(), request)
+	case "list":
+		if err := printBackupList(); err != nil {
+			log.Printf(I18n("backup_dir_get_failed"), err)
+		}
+	case "restore":
+		go func() {
+			if err := runRestoreCommand(fields[1:]); err != nil {
+				log.Printf(I18n("restore_failed"), err)
+			}
+		}()
+	case "prune":
+		go func() {
+			if err := runPruneCommand(fields[1:]); err != nil {
+				log.Printf(I18n("prune_failed"), err)
+			}
+		}()
 	case "exit":
 		log.Println(I18n("manager_exit_command_received"))
-		if p, err := os.FindProcess(os.Getpid()); err == nil {
-			p.Signal(syscall.SIGINT)
-		}
+		shutdown()
 	}
 }
 
-// runBackupScheduler 備份trigger
+// runBackupScheduler 備份trigger 每個有排程的 job 各自計時
 func runBackupScheduler(ctx context.Context) {
-	interval, err := time.ParseDuration(config.Backup.Interval)
-	if err != nil {
-		log.Printf(I18n("config_backup_interval_format_invalid"), config.Backup.Interval, err)
-		return
+	var wg sync.WaitGroup
+	for _, job := range backupJobs {
+		if job.schedule == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runJobSchedule(ctx, job)
+		}()
 	}
+	wg.Wait()
+}
 
-	log.Printf(I18n("backup_scheduled_enabled"), interval)
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for {
+// runJobSchedule 每次都依排程重新計算下一次的時間 不會隨啟動時間漂移
+func runJobSchedule(ctx context.Context, job *BackupJob) {
+	next := job.schedule.next(time.Now())
+	log.Printf(I18n("backup_scheduled_enabled"), job.displayName(), job.Schedule, next.Format("2006-01-02 15:04:05"))
+	for !next.IsZero() {
+		timer := time.NewTimer(time.Until(next))
 		select {
-		case <-ticker.C:
-			go runBackup()
+		case <-timer.C:
+			go runBackup(job, backupRequest{trigger: triggerScheduled, by: job.Schedule})
+			next = job.schedule.next(time.Now())
 		case <-ctx.Done():
+			timer.Stop()
 			return
 		}
 	}
 }
 
-// runBackup 
-func runBackup() {
-	if !backupMutex.TryLock() {
+// backupRequest 觸發備份的來源 手動備份可以加上標籤並保護
+type backupRequest struct {
+	trigger string
+	by      string // 觸發者 手動備份為系統使用者 排程備份為排程
+	label   string
+	pinned  bool
+}
+
+// consoleUser 執行 manager 的系統使用者 記錄為手動備份的觸發者
+func consoleUser() string {
+	u, err := user.Current()
+	if err != nil || u.Username == "" {
+		return "console"
+	}
+	// Windows 的使用者名稱包含網域 (DOMAIN\user)
+	name := u.Username
+	if i := strings.LastIndex(name, `\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// runBackup 同一個 job 執行中時略過 不同 job 依序執行
+func runBackup(job *BackupJob, request backupRequest) {
+	if !job.running.TryLock() {
 		log.Println(I18n("backup_skipped_previous_unfinished"))
 		return
 	}
+	defer job.running.Unlock()
+	backupMutex.Lock()
 	defer backupMutex.Unlock()
 
 	log.Println("====================")
-	log.Println(I18n("backup_started"))
+	if job.Name != "" {
+		log.Printf(I18n("backup_job_started"), job.Name)
+	} else {
+		log.Println(I18n("backup_started"))
+	}
+	if request.label != "" {
+		log.Printf(I18n("backup_label"), request.label, request.trigger, request.by)
+	}
 	startTime := time.Now()
 
-	backupFilename := fmt.Sprintf("backup-%s.zip", startTime.Format("2006-01-02_15-04-05"))
-	backupFilepath := filepath.Join(config.Backup.Destination, backupFilename)
+	if err := ensureFreeSpace(job); err != nil {
+		log.Printf(I18n("backup_aborted"), err)
+		log.Println("====================")
+		return
+	}
 
-	filesToBackup, err := collectFiles()
+	resumeAutoSave := suspendAutoSave()
+	defer resumeAutoSave()
+
+	filesToBackup, err := collectFiles(job)
 	if err != nil {
 		log.Printf(I18n("backup_collect_files_failed"), err)
 		return
@@ -305,41 +501,132 @@ func runBackup() {
 		return
 	}
 
-	if err := createZipArchive(backupFilepath, filesToBackup); err != nil {
+	var result *backupResult
+	switch config.Backup.Mode {
+	case backupModeRepository:
+		result, err = createSnapshot(job, request, startTime, filesToBackup)
+	case backupModeIncremental:
+		result, err = createIncrementalBackup(job, request, startTime, filesToBackup)
+	default:
+		result, err = createArchiveBackup(job, request, startTime, filesToBackup)
+	}
+	resumeAutoSave()
+	if err != nil {
 		log.Printf(I18n("backup_create_archive_failed"), err)
-		os.Remove(backupFilepath)
 		return
 	}
+	if result.failed > 0 {
+		log.Printf(I18n("backup_partial"), result.failed, len(filesToBackup))
+	}
 
-	cleanupBackups()
+	verified := ""
+	if config.Backup.VerifyAfterBackup {
+		verified = verifyGood
+		if err := verifyBackup(result.path); errors.Is(err, errNoIdentity) {
+			// 只設定公鑰時本機無法解密
+			verified = ""
+			log.Printf(I18n("verify_skipped_no_identity"), result.name)
+		} else if err != nil {
+			verified = verifyBad
+			log.Printf(I18n("verify_archive_bad"), result.name, err)
+		} else {
+			log.Printf(I18n("verify_archive_good"), result.name)
+		}
+	}
 
 	duration := time.Since(startTime).Round(time.Second)
-	fileInfo, err := os.Stat(backupFilepath)
-	if err == nil {
-		fileSizeMB := float64(fileInfo.Size()) / 1024 / 1024
-		log.Printf(I18n("backup_successful_size"), backupFilepath, fileSizeMB)
-	} else {
-		log.Printf(I18n("backup_successful"), backupFilepath)
+	rec := BackupRecord{
+		File:     result.name,
+		Time:     startTime,
+		Size:     result.size,
+		RawSize:  result.raw,
+		Files:    result.files,
+		Duration: duration,
+		Trigger:  request.trigger,
+		By:       request.by,
+		Partial:  result.failed > 0,
+		Verified: verified,
+		Base:     result.base,
+		Job:      job.Name,
+		Label:    request.label,
+		Pinned:   request.pinned,
+	}
+	recordBackup(job.Destination, rec)
+	if request.pinned {
+		log.Printf(I18n("backup_pinned"), result.name)
 	}
+
+	cleanupBackups(job)
+	enqueueReplication(job, rec)
+
+	log.Printf(I18n("backup_successful_size"), result.path, float64(result.size)/1024/1024)
 	log.Printf(I18n("backup_total_time"), duration)
 	log.Println("====================")
 }
 
-// createZipArchive
-func createZipArchive(archivePath string, files []string) error {
+// backupResult 完成的備份
+type backupResult struct {
+	path   string
+	name   string
+	files  int
+	failed int
+	size   int64
+	raw    int64 // 備份的檔案未壓縮的大小
+	base   string
+}
+
+// createArchiveBackup 完整備份
+func createArchiveBackup(job *BackupJob, request backupRequest, startTime time.Time, files []string) (*backupResult, error) {
+	backupFilename := backupBaseName(job, startTime, request) + archiveExtension(job.Format)
+	return writeArchiveBackup(job, backupFilename, files, newManifest())
+}
+
+// writeArchiveBackup 寫入 .partial 後重新命名為完整的備份檔
+func writeArchiveBackup(job *BackupJob, backupFilename string, files []string, manifest *Manifest) (*backupResult, error) {
+	backupFilepath := filepath.Join(job.Destination, backupFilename)
+	partialFilepath := backupFilepath + partialSuffix
+
+	err := createArchive(partialFilepath, job.Format, files, manifest)
+	if err == nil {
+		err = os.Rename(partialFilepath, backupFilepath)
+	}
+	if err != nil {
+		os.Remove(partialFilepath)
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(backupFilepath)
+	if err != nil {
+		return nil, err
+	}
+	var raw int64
+	for _, f := range manifest.Files {
+		raw += f.Size
+	}
+	return &backupResult{
+		path:   backupFilepath,
+		name:   backupFilename,
+		files:  len(manifest.Files) + len(manifest.Unchanged),
+		failed: len(manifest.Failed),
+		size:   fileInfo.Size(),
+		raw:    raw,
+		base:   manifest.Base,
+	}, nil
+}
+
+// createArchive
+func createArchive(archivePath, format string, files []string, manifest *Manifest) error {
 	archiveFile, err := os.Create(archivePath)
 	if err != nil {
 		return err
 	}
 	defer archiveFile.Close()
 
-	zipWriter := zip.NewWriter(archiveFile)
-	defer zipWriter.Close()
-
-	compressor := func(out io.Writer) (io.WriteCloser, error) {
-		return flate.NewWriter(out, config.Backup.CompressionLevel)
+	archive, err := newArchiveWriter(format, archiveFile, filepath.Dir(archivePath))
+	if err != nil {
+		return err
 	}
-	zipWriter.RegisterCompressor(zip.Deflate, compressor)
+	defer archive.Close()
 
 	var wg sync.WaitGroup
 	var writerMutex sync.Mutex
@@ -350,9 +637,13 @@ func createZipArchive(archivePath string, files []string) error {
 		go func() {
 			defer wg.Done()
 			for path := range jobs {
-				if err := addFileToZip(zipWriter, path, &writerMutex); err != nil {
+				entry, err := addFileToArchive(archive, path, &writerMutex)
+				if err != nil {
 					log.Printf(I18n("backup_add_file_to_archive_failed"), path, err)
+					manifest.addFailure(archiveEntryName(path), err)
+					continue
 				}
+				manifest.addFile(entry)
 			}
 		}()
 	}
@@ -363,59 +654,109 @@ func createZipArchive(archivePath string, files []string) error {
 	close(jobs)
 
 	wg.Wait()
-	return nil
-}
 
-// addFileToZip
-func addFileToZip(zipWriter *zip.Writer, filePath string, m *sync.Mutex) error {
-	fileToZip, err := os.Open(filePath)
-	if err != nil {
+	if err := manifest.writeTo(archive); err != nil {
 		return err
 	}
-	defer fileToZip.Close()
-
-	info, err := fileToZip.Stat()
-	if err != nil {
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := archiveFile.Sync(); err != nil {
 		return err
 	}
+	return archiveFile.Close()
+}
 
-	workDir := mustGetwd()
-	relativePath, err := filepath.Rel(workDir, filePath)
+// addFileToArchive
+func addFileToArchive(archive archiveWriter, filePath string, m *sync.Mutex) (ManifestFile, error) {
+	fileToArchive, err := os.Open(filePath)
 	if err != nil {
-		relativePath = filepath.Base(filePath)
+		return ManifestFile{}, err
 	}
+	defer fileToArchive.Close()
 
-	header, err := zip.FileInfoHeader(info)
+	info, err := fileToArchive.Stat()
 	if err != nil {
-		return err
+		return ManifestFile{}, err
 	}
-	header.Name = filepath.ToSlash(relativePath)
-	header.Method = zip.Deflate
 
-	m.Lock()
-	defer m.Unlock()
+	header := archiveHeader{
+		Name:     archiveEntryName(filePath),
+		Size:     info.Size(),
+		Mode:     info.Mode(),
+		Modified: info.ModTime(),
+	}
 
-	writer, err := zipWriter.CreateHeader(header)
-	if err != nil {
-		return err
+	hasher := sha256.New()
+	counter := &countingReader{reader: io.TeeReader(fileToArchive, hasher)}
+	if parallel, ok := archive.(parallelArchiveWriter); ok {
+		// 壓縮不需要鎖 只有寫入 archive 時才依序進行
+		entry, err := parallel.compressEntry(header, counter)
+		if err != nil {
+			return ManifestFile{}, err
+		}
+		defer entry.Close()
+
+		m.Lock()
+		err = parallel.writeCompressed(entry)
+		m.Unlock()
+		if err != nil {
+			return ManifestFile{}, err
+		}
+	} else {
+		m.Lock()
+		err := archive.writeEntry(header, counter)
+		m.Unlock()
+		if err != nil {
+			return ManifestFile{}, err
+		}
 	}
+	return ManifestFile{
+		Path:    header.Name,
+		Size:    counter.n,
+		ModTime: info.ModTime(),
+		SHA256:  hex.EncodeToString(hasher.Sum(nil)),
+	}, nil
+}
 
-	_, err = io.Copy(writer, fileToZip)
-	return err
+// countingReader 記錄讀取的位元組數
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
-// collectFiles
-func collectFiles() ([]string, error) {
+// archiveEntryName 檔案在備份中的路徑 (相對工作目錄)
+func archiveEntryName(filePath string) string {
+	workDir := mustGetwd()
+	relativePath, err := filepath.Rel(workDir, filePath)
+	if err != nil {
+		relativePath = filepath.Base(filePath)
+	}
+	return filepath.ToSlash(relativePath)
+}
+
+// collectFiles 依排除規則走訪備份來源 被排除的資料夾不會進入
+func collectFiles(job *BackupJob) ([]string, error) {
 	var files []string
-	for _, sourcePath := range config.Backup.Sources {
-		err := filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+	for _, sourcePath := range job.Sources {
+		rules := loadExcludeRules(sourcePath, job.Exclusions)
+		err := filepath.WalkDir(sourcePath, func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
-			if info.IsDir() {
+			if rules.excluded(path, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
 				return nil
 			}
-			if isExcluded(path) {
+			if d.IsDir() {
 				return nil
 			}
 			files = append(files, path)
@@ -432,80 +773,171 @@ func collectFiles() ([]string, error) {
 	return files, nil
 }
 
-// isExcluded
-func isExcluded(path string) bool {
-	workDir := mustGetwd()
-	relPath, err := filepath.Rel(workDir, path)
+// cleanupPartialBackups 刪除上次崩潰時留下的未完成備份
+func cleanupPartialBackups(dir string) {
+	files, err := os.ReadDir(dir)
 	if err != nil {
-		relPath = path
+		log.Printf(I18n("backup_dir_get_failed"), err)
+		return
 	}
-	relPath = filepath.ToSlash(relPath)
-	for _, pattern := range config.Backup.Exclusions {
-		pattern = filepath.ToSlash(pattern)
-		match, _ := filepath.Match(pattern, relPath)
-		if match {
-			return true
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), partialSuffix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, file.Name())); err == nil {
+			log.Printf(I18n("backup_partial_file_removed"), file.Name())
 		}
 	}
-	return false
 }
 
-// cleanupBackups
-func cleanupBackups() {
-	files, err := os.ReadDir(config.Backup.Destination)
+// cleanupBackups 保留規則只計算同一個 job 的備份 大小限制計算整個備份目錄
+func cleanupBackups(job *BackupJob) {
+	dir := job.Destination
+	backups, err := listBackups(dir)
 	if err != nil {
 		log.Printf(I18n("backup_dir_get_failed"), err)
 		return
 	}
 
-	var backups []os.FileInfo
-	for _, file := range files {
-		if !file.IsDir() && strings.HasPrefix(file.Name(), "backup-") && strings.HasSuffix(file.Name(), ".zip") {
-			if info, err := file.Info(); err == nil {
-				backups = append(backups, info)
-			}
-		}
-	}
-
 	if len(backups) == 0 {
 		return
 	}
 
-	sort.Slice(backups, func(i, j int) bool {
-		return backups[i].ModTime().Before(backups[j].ModTime())
-	})
+	var deleted []string
+	defer func() { forgetBackups(dir, deleted) }()
+
+	// 還沒複製到遠端的備份不刪除
+	pending := pendingReplications(dir)
 
-	if config.Backup.RetentionCount > 0 && len(backups) > config.Backup.RetentionCount {
-		toDeleteCount := len(backups) - config.Backup.RetentionCount
-		log.Printf(I18n("backup_pruning_by_count_limit"), len(backups), config.Backup.RetentionCount, toDeleteCount)
-		for i := 0; i < toDeleteCount; i++ {
-			fileToDelete := backups[i]
-			pathToDelete := filepath.Join(config.Backup.Destination, fileToDelete.Name())
+	if len(config.Backup.rules()) > 0 {
+		own := jobBackups(backups, job)
+		var toDelete []BackupRecord
+		for _, d := range planRetention(backups, own, config.Backup.RetentionPolicy, pending) {
+			if !d.keep() {
+				toDelete = append(toDelete, d.record)
+			} else if slices.Equal(d.reasons, []string{pendingReplicationReason}) {
+				log.Printf(I18n("backup_kept_pending_replication"), d.record.File)
+			}
+		}
+		if len(toDelete) > 0 {
+			log.Printf(I18n("backup_pruning_by_retention"), len(own)-len(toDelete), len(own), len(toDelete))
+		}
+		for _, fileToDelete := range toDelete {
+			pathToDelete := filepath.Join(dir, filepath.FromSlash(fileToDelete.File))
 			if err := os.Remove(pathToDelete); err == nil {
-				log.Printf(I18n("backup_pruned_by_count_limit"), fileToDelete.Name())
+				deleted = append(deleted, fileToDelete.File)
+				log.Printf(I18n("backup_pruned_by_retention"), fileToDelete.File)
 			}
 		}
-		backups = backups[toDeleteCount:]
+		backups = slices.DeleteFunc(backups, func(b BackupRecord) bool {
+			return slices.Contains(deleted, b.File)
+		})
+		collectGarbageIfNeeded(dir, deleted)
 	}
 
 	if config.Backup.MaxTotalSizeGB > 0 {
 		maxSizeBytes := int64(config.Backup.MaxTotalSizeGB) * 1024 * 1024 * 1024
-		var totalSize int64
+
+		// 倉庫中的 snapshot 共用 chunk 以實際可釋放的空間計算
+		var usage *repoUsage
+		if hasRepository(dir) {
+			if usage, err = loadRepoUsage(dir); err != nil {
+				log.Printf(I18n("repository_gc_failed"), err)
+				return
+			}
+		}
+
+		// 受保護的備份不計入大小限制 倉庫中受保護的 snapshot 參照的 chunk 刪除其他 snapshot 也無法釋放 同樣不計入
+		var totalSize, pinnedSize int64
+		var pinnedSnapshots []string
 		for _, b := range backups {
-			totalSize += b.Size()
+			switch {
+			case b.Pinned && isSnapshotFile(b.File):
+				pinnedSnapshots = append(pinnedSnapshots, b.File)
+			case b.Pinned:
+				pinnedSize += b.Size
+			case !isSnapshotFile(b.File):
+				totalSize += b.Size
+			}
 		}
+		if usage != nil {
+			held := usage.pinned(pinnedSnapshots)
+			totalSize += usage.total - held
+			pinnedSize += held
+		}
+		if pinnedSize > maxSizeBytes {
+			log.Printf(I18n("backup_pinned_exceed_size_limit"), float64(pinnedSize)/1e9, config.Backup.MaxTotalSizeGB)
+		}
+
 		if totalSize > maxSizeBytes {
 			log.Printf(I18n("backup_pruning_by_size_limit"), float64(totalSize)/1e9, config.Backup.MaxTotalSizeGB)
-			for totalSize > maxSizeBytes && len(backups) > 0 {
-				fileToDelete := backups[0]
-				pathToDelete := filepath.Join(config.Backup.Destination, fileToDelete.Name())
-				if err := os.Remove(pathToDelete); err == nil {
-					totalSize -= fileToDelete.Size()
-					backups = backups[1:]
-				} else {
-					break
-				}
+			// 剛完成的備份 (job 最新的備份) 不刪除
+			own := jobBackups(backups, job)
+			var newest string
+			if len(own) > 0 {
+				newest = own[len(own)-1].File
 			}
+			var freedTotal int64
+			prunedBySize := pruneOldest(dir, backups, usage, func(b BackupRecord) bool {
+				return b.File != newest && !pending[b.File]
+			}, func(freed int64) bool {
+				freedTotal = freed
+				return totalSize-freed <= maxSizeBytes
+			})
+			// 遠端長時間無法使用時 還沒複製的備份也依大小限制刪除 避免本機磁碟被佔滿
+			if totalSize-freedTotal > maxSizeBytes && len(pending) > 0 {
+				log.Printf(I18n("backup_size_limit_pending_replication"), config.Backup.MaxTotalSizeGB)
+				remaining := slices.DeleteFunc(slices.Clone(backups), func(b BackupRecord) bool {
+					return slices.Contains(prunedBySize, b.File)
+				})
+				prunedBySize = append(prunedBySize, pruneOldest(dir, remaining, usage, func(b BackupRecord) bool {
+					return b.File != newest
+				}, func(freed int64) bool {
+					return totalSize-freedTotal-freed <= maxSizeBytes
+				})...)
+			}
+			deleted = append(deleted, prunedBySize...)
+			collectGarbageIfNeeded(dir, prunedBySize)
+		}
+	}
+}
+
+// pruneOldest 由舊到新刪除沒有其他備份依賴 也沒有被保護的備份 (增量鏈由新到舊刪除)
+// eligible 為 nil 時所有備份都可刪除 done 回傳 true 時停止 回傳已刪除的備份
+func pruneOldest(dir string, backups []BackupRecord, usage *repoUsage, eligible func(BackupRecord) bool, done func(freed int64) bool) []string {
+	backups = slices.Clone(backups)
+	var deleted []string
+	var freed int64
+	for !done(freed) && len(backups) > 0 {
+		required := requiredBases(backups, backups)
+		index := slices.IndexFunc(backups, func(b BackupRecord) bool {
+			return !b.Pinned && !required[b.File] && (eligible == nil || eligible(b))
+		})
+		if index < 0 {
+			break
+		}
+		fileToDelete := backups[index]
+		pathToDelete := filepath.Join(dir, filepath.FromSlash(fileToDelete.File))
+		if err := os.Remove(pathToDelete); err != nil {
+			break
+		}
+		deleted = append(deleted, fileToDelete.File)
+		if isSnapshotFile(fileToDelete.File) && usage != nil {
+			freed += usage.release(fileToDelete.File)
+		} else {
+			freed += fileToDelete.Size
+		}
+		backups = append(backups[:index], backups[index+1:]...)
+	}
+	return deleted
+}
+
+// collectGarbageIfNeeded 刪除過 snapshot 時清理倉庫
+func collectGarbageIfNeeded(dir string, deleted []string) {
+	for _, name := range deleted {
+		if isSnapshotFile(name) {
+			collectGarbage(dir)
+			return
 		}
 	}
 }
@@ -529,6 +961,7 @@ func setupLogger() error {
 	mw := io.MultiWriter(os.Stdout, logFile)
 	log.SetOutput(mw)
 	log.SetFlags(log.Ldate | log.Ltime)
+	serverLogger = log.New(logFile, "[server] ", log.Ldate|log.Ltime)
 	return nil
 }
 
@@ -542,9 +975,14 @@ func loadConfig() error {
 		}
 		return fmt.Errorf(I18n("config_user_action_required"), configPath, configPath)
 	}
-	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+	md, err := toml.DecodeFile(configPath, &config)
+	if err != nil {
 		return fmt.Errorf(I18n("config_parse_failed"), err)
 	}
+	// 舊的設定檔沒有 save_control 時預設啟用 避免備份到寫入中的區域檔
+	if !md.IsDefined("backup", "save_control") {
+		config.Backup.SaveControl = true
+	}
 	return normalizeConfigPathsAndDefaults()
 }
 
@@ -554,7 +992,7 @@ func normalizeConfigPathsAndDefaults() error {
 	
 	// Java Path
 	if config.Server.JavaPath == "" {
-		return fmt.Errorf(I18n("config_java_path_required"))
+		return errors.New(I18n("config_java_path_required"))
 	}
 	config.Server.JavaPath = filepath.Clean(config.Server.JavaPath)
 	
@@ -580,6 +1018,41 @@ func normalizeConfigPathsAndDefaults() error {
 		return fmt.Errorf(I18n("backup_dir_create_failed"), config.Backup.Destination, err)
 	}
 	
+	// Server defaults
+	if config.Server.StopTimeoutSeconds <= 0 {
+		config.Server.StopTimeoutSeconds = 60
+	}
+
+	// Backup mode
+	switch config.Backup.Mode {
+	case "":
+		config.Backup.Mode = backupModeFull
+	case backupModeFull, backupModeRepository, backupModeIncremental:
+	default:
+		return fmt.Errorf(I18n("config_backup_mode_invalid"), config.Backup.Mode)
+	}
+	if config.Backup.Format == "" {
+		config.Backup.Format = formatZip
+	}
+	if !slices.Contains(archiveFormats, config.Backup.Format) {
+		return fmt.Errorf(I18n("config_backup_format_invalid"), config.Backup.Format)
+	}
+	if config.Backup.FullEvery <= 0 {
+		config.Backup.FullEvery = 7
+	}
+	if err := validateExclusions(config.Backup.Exclusions); err != nil {
+		return err
+	}
+	if err := normalizeBackupJobs(workDir); err != nil {
+		return err
+	}
+	if err := normalizeBackupRemotes(workDir); err != nil {
+		return err
+	}
+	if err := normalizeBackupEncryption(workDir); err != nil {
+		return err
+	}
+
 	// Other defaults
 	if config.Backup.Workers <= 0 {
 		config.Backup.Workers = 4
@@ -587,8 +1060,11 @@ func normalizeConfigPathsAndDefaults() error {
 	if config.Backup.CompressionLevel < flate.NoCompression || config.Backup.CompressionLevel > flate.BestCompression {
 		config.Backup.CompressionLevel = 5
 	}
+	if config.Backup.SaveTimeoutSeconds <= 0 {
+		config.Backup.SaveTimeoutSeconds = 60
+	}
 	if len(config.Backup.ManagerCommands) == 0 {
-		config.Backup.ManagerCommands = []string{"backup", "exit"}
+		config.Backup.ManagerCommands = []string{"backup", "list", "restore", "prune", "exit"}
 	}
 	
 	// Discord defaults
@@ -598,6 +1074,7 @@ func normalizeConfigPathsAndDefaults() error {
 	if config.Discord.IngameFormat == "" {
 		config.Discord.IngameFormat = "[Discord] <{{ .Username }}> {{ .Message }}"
 	}
+	events.setPatterns(compileEventPatterns())
 	return nil
 }
 
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 每個備份檔內的檔案清單
+const manifestFileName = "manifest.json"
+
+// Manifest 備份內容與校驗碼
+type Manifest struct {
+	Version int               `json:"version"`
+	Created time.Time         `json:"created"`
+	Files   []ManifestFile    `json:"files"`
+	Failed  []ManifestFailure `json:"failed,omitempty"`
+
+	// 增量備份: 基準備份 (catalog 名稱) 與沿用基準內容的檔案
+	Base      string         `json:"base,omitempty"`
+	Unchanged []ManifestFile `json:"unchanged,omitempty"`
+
+	mu sync.Mutex
+}
+
+// ManifestFile 已備份的檔案
+type ManifestFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// ManifestFailure 無法加入備份的檔案
+type ManifestFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+func newManifest() *Manifest {
+	return &Manifest{Version: 1, Created: time.Now()}
+}
+
+// addFile
+func (m *Manifest) addFile(f ManifestFile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Files = append(m.Files, f)
+}
+
+// addFailure
+func (m *Manifest) addFailure(path string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Failed = append(m.Failed, ManifestFailure{Path: path, Error: err.Error()})
+}
+
+// failed 檔案是否無法完整加入備份
+func (m *Manifest) failed(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.Failed {
+		if f.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// partial 是否有檔案未能加入備份
+func (m *Manifest) partial() bool {
+	return len(m.Failed) > 0
+}
+
+// writeTo 以 manifest.json 寫入備份檔
+func (m *Manifest) writeTo(archive archiveWriter) error {
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	sort.Slice(m.Failed, func(i, j int) bool { return m.Failed[i].Path < m.Failed[j].Path })
+	sort.Slice(m.Unchanged, func(i, j int) bool { return m.Unchanged[i].Path < m.Unchanged[j].Path })
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return archive.writeEntry(archiveHeader{
+		Name:     manifestFileName,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		Modified: m.Created,
+	}, bytes.NewReader(data))
+}
+// readManifest 讀取備份檔內的 manifest.json 舊備份沒有時回傳 nil
+func readManifest(zipReader *zip.Reader) (*Manifest, error) {
+	for _, f := range zipReader.File {
+		if f.Name != manifestFileName {
+			continue
+		}
+		reader, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return decodeManifest(reader)
+	}
+	return nil, nil
+}
\ No newline at end of file
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// errMirrorUnavailable 鏡像目錄不存在 (例如外接硬碟未掛載)
+var errMirrorUnavailable = errors.New("mirror directory is not available")
+
+// directoryStore 另一個已掛載的目錄 (外接硬碟、網路磁碟)
+type directoryStore struct {
+	root string
+}
+
+// newDirectoryStore path 需指向掛載點之中的目錄 不會自動建立 以免未掛載時寫入系統磁碟
+func newDirectoryStore(remote *BackupRemote, workDir string) (*directoryStore, error) {
+	if remote.Path == "" {
+		return nil, errors.New("path is required")
+	}
+	root := remote.Path
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(workDir, root)
+	}
+	root = filepath.Clean(root)
+	for _, job := range backupJobs {
+		if rel, err := filepath.Rel(job.Destination, root); err == nil && filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("path %s is inside the backup destination %s", root, job.Destination)
+		}
+	}
+	return &directoryStore{root: root}, nil
+}
+
+// available 鏡像目錄是否存在
+func (s *directoryStore) available() error {
+	info, err := os.Stat(s.root)
+	if err != nil || !info.IsDir() {
+		return fmt.Errorf("%w: %s", errMirrorUnavailable, s.root)
+	}
+	return nil
+}
+
+// put 寫入 .partial 並同步到磁碟 讀回比對 SHA-256 後重新命名
+func (s *directoryStore) put(name string, r io.ReadSeeker, size int64) error {
+	if err := s.available(); err != nil {
+		return err
+	}
+	target := filepath.Join(s.root, filepath.FromSlash(name))
+	partial := target + partialSuffix
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	f, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(f, io.TeeReader(r, h))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("copied %d bytes of %s, expected %d", n, name, size)
+	}
+	if err == nil {
+		err = verifyFileSHA256(partial, h.Sum(nil))
+	}
+	if err == nil {
+		err = os.Rename(partial, target)
+	}
+	if err != nil {
+		os.Remove(partial)
+	}
+	return err
+}
+
+// verifyFileSHA256 重新讀取檔案並比對 SHA-256
+func verifyFileSHA256(path string, sum []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return fmt.Errorf("copy of %s does not match the original (SHA-256 %x, expected %x)", filepath.Base(path), h.Sum(nil), sum)
+	}
+	return nil
+}
+
+// get
+func (s *directoryStore) get(name string) (io.ReadCloser, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(s.root, filepath.FromSlash(name)))
+}
+
+// remove
+func (s *directoryStore) remove(name string) error {
+	if err := s.available(); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(s.root, filepath.FromSlash(name)))
+}
\ No newline at end of file
@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// isolateProcess 伺服器使用獨立的行程群組 終端 Ctrl+C 不會直接傳給 JVM
+func isolateProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
\ No newline at end of file
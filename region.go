@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Anvil 區域檔 (.mca) 格式
+const (
+	regionSectorSize  = 4096
+	regionHeaderSize  = 2 * regionSectorSize
+	regionChunkCount  = 1024
+	regionMaxFileSize = 256 << 20
+)
+
+var errNotRegionFile = errors.New("not a valid region file")
+
+// RegionLayout 區域檔中每個 chunk 資料的位置
+// 其餘位元組 (標頭 時間戳 sector 填充) 依序存在 SnapshotFile.Chunks
+type RegionLayout struct {
+	Payloads []RegionPayload `json:"payloads"`
+}
+
+// RegionPayload 一個 Minecraft chunk 的資料 (含 4 位元組長度與壓縮類型)
+type RegionPayload struct {
+	Offset int64  `json:"o"`
+	Length int64  `json:"n"`
+	Hash   string `json:"h"`
+}
+
+// isRegionFile
+func isRegionFile(path string) bool {
+	return strings.HasSuffix(path, ".mca")
+}
+
+// parseRegion 解析區域檔標頭 回傳依位置排序的 chunk 資料範圍
+func parseRegion(data []byte) ([]RegionPayload, error) {
+	if len(data) < regionHeaderSize {
+		return nil, errNotRegionFile
+	}
+
+	var payloads []RegionPayload
+	for i := 0; i < regionChunkCount; i++ {
+		location := binary.BigEndian.Uint32(data[i*4:])
+		sectorOffset := int64(location >> 8)
+		sectorCount := int64(location & 0xFF)
+		if location == 0 {
+			continue
+		}
+		if sectorOffset < 2 || sectorCount == 0 {
+			return nil, errNotRegionFile
+		}
+
+		start := sectorOffset * regionSectorSize
+		if start+5 > int64(len(data)) {
+			return nil, errNotRegionFile
+		}
+		length := int64(binary.BigEndian.Uint32(data[start:]))
+		end := start + 4 + length
+		if length == 0 || end > int64(len(data)) || length+4 > sectorCount*regionSectorSize {
+			return nil, errNotRegionFile
+		}
+		payloads = append(payloads, RegionPayload{Offset: start, Length: end - start})
+	}
+
+	sort.Slice(payloads, func(i, j int) bool { return payloads[i].Offset < payloads[j].Offset })
+	for i := 1; i < len(payloads); i++ {
+		if payloads[i].Offset < payloads[i-1].Offset+payloads[i-1].Length {
+			return nil, errNotRegionFile
+		}
+	}
+	return payloads, nil
+}
+
+// storeRegionFile 每個 Minecraft chunk 單獨以 hash 儲存 其餘位元組以一般方式切塊
+func (r *repository) storeRegionFile(filePath string, entry SnapshotFile) (SnapshotFile, int64, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return entry, 0, err
+	}
+	if info.Size() > regionMaxFileSize {
+		return entry, 0, errNotRegionFile
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return entry, 0, err
+	}
+	payloads, err := parseRegion(data)
+	if err != nil {
+		return entry, 0, err
+	}
+
+	var added int64
+	var residual bytes.Buffer
+	pos := int64(0)
+	for i, p := range payloads {
+		residual.Write(data[pos:p.Offset])
+		sum := sha256.Sum256(data[p.Offset : p.Offset+p.Length])
+		payloads[i].Hash = hex.EncodeToString(sum[:])
+		n, err := r.putChunk(payloads[i].Hash, data[p.Offset:p.Offset+p.Length])
+		added += n
+		if err != nil {
+			return entry, added, err
+		}
+		pos = p.Offset + p.Length
+	}
+	residual.Write(data[pos:])
+
+	err = splitChunks(&residual, func(chunk []byte) error {
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		n, err := r.putChunk(hash, chunk)
+		added += n
+		entry.Chunks = append(entry.Chunks, hash)
+		return err
+	})
+	if err != nil {
+		return entry, added, err
+	}
+
+	fileSum := sha256.Sum256(data)
+	entry.Size = int64(len(data))
+	entry.SHA256 = hex.EncodeToString(fileSum[:])
+	entry.Region = &RegionLayout{Payloads: payloads}
+	return entry, added, nil
+}
+
+// regionReader 將 chunk 資料插回原位置 重建逐位元組相同的區域檔
+type regionReader struct {
+	repo     *repository
+	residual io.Reader
+	payloads []RegionPayload
+	pos      int64
+	buf      []byte
+}
+
+func (rr *regionReader) Read(p []byte) (int, error) {
+	if len(rr.buf) > 0 {
+		n := copy(p, rr.buf)
+		rr.buf = rr.buf[n:]
+		rr.pos += int64(n)
+		return n, nil
+	}
+
+	if len(rr.payloads) > 0 && rr.pos == rr.payloads[0].Offset {
+		data, err := rr.repo.readChunk(rr.payloads[0].Hash)
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(data)) != rr.payloads[0].Length {
+			return 0, errNotRegionFile
+		}
+		rr.payloads = rr.payloads[1:]
+		rr.buf = data
+		return rr.Read(p)
+	}
+
+	if len(rr.payloads) > 0 {
+		if gap := rr.payloads[0].Offset - rr.pos; int64(len(p)) > gap {
+			p = p[:gap]
+		}
+	}
+	n, err := rr.residual.Read(p)
+	rr.pos += int64(n)
+	if errors.Is(err, io.EOF) && len(rr.payloads) > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
\ No newline at end of file
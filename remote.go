@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// 遠端類型
+const (
+	remoteTypeS3        = "s3"
+	remoteTypeSFTP      = "sftp"
+	remoteTypeDirectory = "directory"
+)
+
+// BackupRemote 異地備份目標 完成的備份會複製到遠端 遠端套用自己的保留規則
+type BackupRemote struct {
+	Name string   `toml:"name"`
+	Type string   `toml:"type"`
+	Jobs []string `toml:"jobs"` // 只複製這些 job 的備份 空白為全部
+
+	// s3
+	Endpoint     string `toml:"endpoint"`
+	Region       string `toml:"region"`
+	Bucket       string `toml:"bucket"`
+	Prefix       string `toml:"prefix"`
+	PathStyle    bool   `toml:"path_style"`
+	AccessKeyEnv string `toml:"access_key_env"`
+	SecretKeyEnv string `toml:"secret_key_env"`
+	PartSizeMB   int    `toml:"part_size_mb"`
+
+	// sftp 與 directory 使用 path
+	Host             string `toml:"host"`
+	Port             int    `toml:"port"`
+	User             string `toml:"user"`
+	KeyFile          string `toml:"key_file"`
+	KeyPassphraseEnv string `toml:"key_passphrase_env"`
+	KnownHosts       string `toml:"known_hosts"`
+	Path             string `toml:"path"`
+
+	RetentionPolicy
+
+	store remoteStore
+}
+
+// remoteStore 遠端儲存 名稱為相對遠端根目錄的路徑
+type remoteStore interface {
+	// put 上傳並確認遠端內容與 r 相同 失敗時可以重新呼叫
+	put(name string, r io.ReadSeeker, size int64) error
+	// get 不存在時回傳 os.ErrNotExist
+	get(name string) (io.ReadCloser, error)
+	remove(name string) error
+}
+
+// backupRemotes 設定檔中的 [[backup.remotes]]
+var backupRemotes []*BackupRemote
+
+// normalizeBackupRemotes 檢查遠端設定並建立連線設定
+func normalizeBackupRemotes(workDir string) error {
+	backupRemotes = nil
+	names := make(map[string]bool)
+	for i := range config.Backup.Remotes {
+		remote := &config.Backup.Remotes[i]
+		if remote.Name == "" {
+			remote.Name = fmt.Sprintf("remote%d", i+1)
+		}
+		if !jobNamePattern.MatchString(remote.Name) || names[remote.Name] {
+			return fmt.Errorf(I18n("config_backup_remote_name_invalid"), remote.Name)
+		}
+		names[remote.Name] = true
+		// 倉庫的 snapshot 依賴整個倉庫 無法逐一複製
+		if config.Backup.Mode == backupModeRepository {
+			return fmt.Errorf(I18n("config_backup_remote_invalid"), remote.Name, "mode = \"repository\" cannot be replicated")
+		}
+		for _, name := range remote.Jobs {
+			if !slices.ContainsFunc(backupJobs, func(job *BackupJob) bool { return job.Name == name }) {
+				return fmt.Errorf(I18n("config_backup_remote_job_unknown"), remote.Name, name)
+			}
+		}
+
+		var err error
+		switch remote.Type {
+		case remoteTypeS3:
+			remote.store, err = newS3Store(remote)
+		case remoteTypeSFTP:
+			remote.store, err = newSFTPStore(remote)
+		case remoteTypeDirectory:
+			remote.store, err = newDirectoryStore(remote, workDir)
+		default:
+			err = fmt.Errorf("unknown type '%s'", remote.Type)
+		}
+		if err != nil {
+			return fmt.Errorf(I18n("config_backup_remote_invalid"), remote.Name, err)
+		}
+		backupRemotes = append(backupRemotes, remote)
+	}
+	return nil
+}
+
+// replicates 遠端是否複製 job 的備份
+func (r *BackupRemote) replicates(job *BackupJob) bool {
+	return len(r.Jobs) == 0 || slices.Contains(r.Jobs, job.Name)
+}
+
+// replicateBackup 上傳備份與遠端還沒有的增量基準 再更新遠端 catalog 並套用保留規則
+func replicateBackup(remote *BackupRemote, dir string, rec BackupRecord) error {
+	local, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	return updateRemoteCatalog(remote, func(c *backupCatalog) error {
+		for _, b := range remoteChain(local, c, rec) {
+			if err := uploadBackup(remote, dir, b.File); err != nil {
+				return err
+			}
+			setReplicated(dir, b.File, remote.Name, true)
+			b.Replicated = nil
+			c.add(b)
+		}
+		// 受保護的狀態以本機為準
+		for i := range c.Backups {
+			if j := slices.IndexFunc(local, func(b BackupRecord) bool { return b.File == c.Backups[i].File }); j >= 0 {
+				c.Backups[i].Pinned = local[j].Pinned
+			}
+		}
+		pruneRemote(remote, c)
+		return nil
+	})
+}
+
+// remoteChain rec 與遠端還沒有的基準備份 由舊到新
+func remoteChain(local []BackupRecord, c *backupCatalog, rec BackupRecord) []BackupRecord {
+	chain := []BackupRecord{rec}
+	for base := rec.Base; base != ""; {
+		if slices.ContainsFunc(c.Backups, func(b BackupRecord) bool { return b.File == base }) {
+			break
+		}
+		i := slices.IndexFunc(local, func(b BackupRecord) bool { return b.File == base })
+		if i < 0 {
+			break
+		}
+		chain = append(chain, local[i])
+		base = local[i].Base
+	}
+	slices.Reverse(chain)
+	return chain
+}
+
+// uploadBackup 上傳備份目錄 dir 中的一個備份
+func uploadBackup(remote *BackupRemote, dir, name string) error {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return remote.store.put(name, f, info.Size())
+}
+
+// updateRemoteCatalog 讀取遠端的 catalog 交給 fn 修改後寫回
+func updateRemoteCatalog(remote *BackupRemote, fn func(c *backupCatalog) error) error {
+	c := &backupCatalog{}
+	r, err := remote.store.get(catalogFileName)
+	if err == nil {
+		err = json.NewDecoder(r).Decode(c)
+		r.Close()
+		if err != nil {
+			log.Printf(I18n("catalog_parse_failed"), remote.Name+":"+catalogFileName, err)
+			c = &backupCatalog{}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	fnErr := fn(c)
+	// 上傳失敗時 已上傳的備份仍要登記
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := remote.store.put(catalogFileName, bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// pruneRemote 對遠端每個 job 的備份套用遠端的保留規則
+func pruneRemote(remote *BackupRemote, c *backupCatalog) {
+	if len(remote.rules()) == 0 {
+		return
+	}
+	var jobs []string
+	for _, b := range c.Backups {
+		if !slices.Contains(jobs, b.Job) {
+			jobs = append(jobs, b.Job)
+		}
+	}
+	all := slices.Clone(c.Backups)
+	for _, name := range jobs {
+		for _, d := range planRetention(all, jobBackups(all, &BackupJob{Name: name}), remote.RetentionPolicy, nil) {
+			if d.keep() {
+				continue
+			}
+			if err := remote.store.remove(d.record.File); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf(I18n("remote_prune_failed"), d.record.File, remote.Name, err)
+				continue
+			}
+			c.remove(d.record.File)
+			for _, dir := range backupDestinations() {
+				setReplicated(dir, d.record.File, remote.Name, false)
+			}
+			log.Printf(I18n("remote_pruned"), d.record.File, remote.Name)
+		}
+	}
+}
+
+// retryDelay 第一次重試前的等待時間
+var retryDelay = time.Second
+
+// retry 以指數退避重試 fn 最多 attempts 次
+func retry(attempts int, fn func() error) error {
+	var err error
+	delay := retryDelay
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if i < attempts-1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+// permanentError 重試也不會成功的錯誤
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
\ No newline at end of file
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 備份目錄中等待複製到遠端的佇列
+const replicationQueueFileName = "replication-queue.json"
+
+// 重試間隔 每次失敗加倍
+const (
+	replicationMinBackoff = time.Minute
+	replicationMaxBackoff = 6 * time.Hour
+)
+
+var replicationQueueMutex sync.Mutex
+
+// replicationWake 有新的項目時喚醒背景複製
+var replicationWake = make(chan struct{}, 1)
+
+// replicationTask 等待複製到遠端的備份
+type replicationTask struct {
+	Remote    string    `json:"remote"`
+	File      string    `json:"file"`
+	Attempts  int       `json:"attempts,omitempty"`
+	NextTry   time.Time `json:"next_try"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type replicationQueue struct {
+	Tasks []replicationTask `json:"tasks"`
+}
+
+// readReplicationQueue 讀取佇列檔 不存在時為空 呼叫者需持有 replicationQueueMutex
+func readReplicationQueue(path string) (*replicationQueue, error) {
+	q := &replicationQueue{}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, q); err != nil {
+			log.Printf(I18n("catalog_parse_failed"), path, err)
+			q = &replicationQueue{}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return q, nil
+}
+
+// updateReplicationQueue 讀取備份目錄 dir 的佇列 交給 fn 修改後寫回
+func updateReplicationQueue(dir string, fn func(q *replicationQueue)) error {
+	replicationQueueMutex.Lock()
+	defer replicationQueueMutex.Unlock()
+
+	path := filepath.Join(dir, replicationQueueFileName)
+	q, err := readReplicationQueue(path)
+	if err != nil {
+		return err
+	}
+
+	fn(q)
+
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadReplicationQueue 讀取佇列 不存在時為空 不會寫回檔案
+func loadReplicationQueue(dir string) []replicationTask {
+	replicationQueueMutex.Lock()
+	defer replicationQueueMutex.Unlock()
+
+	q, err := readReplicationQueue(filepath.Join(dir, replicationQueueFileName))
+	if err != nil {
+		log.Printf(I18n("replication_queue_failed"), err)
+		return nil
+	}
+	return q.Tasks
+}
+
+// pendingReplications 佇列中還沒複製到所有遠端的備份
+func pendingReplications(dir string) map[string]bool {
+	pending := make(map[string]bool)
+	for _, task := range loadReplicationQueue(dir) {
+		pending[task.File] = true
+	}
+	return pending
+}
+
+// enqueueReplication 將剛完成的備份排入所有遠端的佇列 由背景複製上傳 不阻擋下一次備份
+func enqueueReplication(job *BackupJob, rec BackupRecord) {
+	if isSnapshotFile(rec.File) {
+		// 倉庫的 snapshot 依賴整個倉庫 不複製
+		return
+	}
+	err := updateReplicationQueue(job.Destination, func(q *replicationQueue) {
+		for _, remote := range backupRemotes {
+			if !remote.replicates(job) || slices.ContainsFunc(q.Tasks, func(t replicationTask) bool {
+				return t.Remote == remote.Name && t.File == rec.File
+			}) {
+				continue
+			}
+			q.Tasks = append(q.Tasks, replicationTask{Remote: remote.Name, File: rec.File, NextTry: time.Now()})
+		}
+	})
+	if err != nil {
+		log.Printf(I18n("replication_queue_failed"), err)
+		return
+	}
+	select {
+	case replicationWake <- struct{}{}:
+	default:
+	}
+}
+
+// runReplicationWorker 處理所有備份目錄的佇列 直到 ctx 結束 佇列保存在磁碟上 重新啟動後繼續
+func runReplicationWorker(ctx context.Context) {
+	for {
+		next := processReplicationQueues()
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-replicationWake:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// processReplicationQueues 複製到期的項目 回傳下一個項目的時間 (沒有時為零值)
+func processReplicationQueues() time.Time {
+	var next time.Time
+	// 這一輪失敗的遠端與下次重試的時間
+	failed := make(map[string]time.Time)
+	for _, dir := range backupDestinations() {
+		for _, task := range loadReplicationQueue(dir) {
+			if retryAt, ok := failed[task.Remote]; ok {
+				task.NextTry = retryAt
+			}
+			if task.NextTry.After(time.Now()) {
+				if next.IsZero() || task.NextTry.Before(next) {
+					next = task.NextTry
+				}
+				continue
+			}
+			retryAt := runReplicationTask(dir, task)
+			if retryAt.IsZero() {
+				continue
+			}
+			failed[task.Remote] = retryAt
+			if next.IsZero() || retryAt.Before(next) {
+				next = retryAt
+			}
+		}
+	}
+	return next
+}
+
+// runReplicationTask 複製一個備份 失敗時延後同一個遠端的所有項目 回傳下次重試的時間
+func runReplicationTask(dir string, task replicationTask) time.Time {
+	remote := findRemote(task.Remote)
+	var rec *BackupRecord
+	if remote != nil {
+		backups, err := listBackups(dir)
+		if err != nil {
+			log.Printf(I18n("backup_dir_get_failed"), err)
+			return time.Now().Add(replicationMinBackoff)
+		}
+		if i := slices.IndexFunc(backups, func(b BackupRecord) bool { return b.File == task.File }); i >= 0 {
+			rec = &backups[i]
+		} else {
+			log.Printf(I18n("remote_upload_missing"), task.File, remote.Name)
+		}
+	}
+
+	var err error
+	if remote != nil && rec != nil {
+		start := time.Now()
+		if err = replicateBackup(remote, dir, *rec); err == nil {
+			log.Printf(I18n("remote_uploaded"), task.File, remote.Name, time.Since(start).Round(time.Second))
+		}
+	}
+	// 成功 或遠端已不在設定中 或備份已被本機清理刪除 都移出佇列
+	if err == nil {
+		updateReplicationQueue(dir, func(q *replicationQueue) {
+			q.Tasks = slices.DeleteFunc(q.Tasks, func(t replicationTask) bool {
+				return t.Remote == task.Remote && t.File == task.File
+			})
+		})
+		return time.Time{}
+	}
+
+	backoff := replicationMinBackoff << min(task.Attempts, 16)
+	if backoff > replicationMaxBackoff {
+		backoff = replicationMaxBackoff
+	}
+	retryAt := time.Now().Add(backoff)
+	log.Printf(I18n("remote_upload_retry"), task.File, remote.Name, retryAt.Format("2006-01-02 15:04:05"), err)
+	updateReplicationQueue(dir, func(q *replicationQueue) {
+		for i := range q.Tasks {
+			t := &q.Tasks[i]
+			if t.Remote != task.Remote {
+				continue
+			}
+			if t.File == task.File {
+				t.Attempts++
+				t.LastError = err.Error()
+			}
+			t.NextTry = retryAt
+		}
+	})
+	return retryAt
+}
+
+// findRemote
+func findRemote(name string) *BackupRemote {
+	for _, remote := range backupRemotes {
+		if remote.Name == name {
+			return remote
+		}
+	}
+	return nil
+}
+
+// setReplicated 記錄備份是否已複製到遠端
+func setReplicated(dir, file, remote string, replicated bool) {
+	err := updateCatalog(dir, func(c *backupCatalog) error {
+		for i := range c.Backups {
+			rec := &c.Backups[i]
+			if rec.File != file {
+				continue
+			}
+			rec.Replicated = slices.DeleteFunc(rec.Replicated, func(name string) bool { return name == remote })
+			if replicated {
+				rec.Replicated = append(rec.Replicated, remote)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf(I18n("catalog_update_failed"), err)
+	}
+}
+
+// replicationStatus backups list 中顯示的複製狀態
+func replicationStatus(rec BackupRecord, queue []replicationTask) string {
+	status := I18n("backups_list_local_only")
+	if len(rec.Replicated) > 0 {
+		status = fmt.Sprintf(I18n("backups_list_replicated"), strings.Join(rec.Replicated, ", "))
+	}
+	var pending []string
+	for _, t := range queue {
+		if t.File == rec.File {
+			pending = append(pending, t.Remote)
+		}
+	}
+	if len(pending) > 0 {
+		status = fmt.Sprintf(I18n("backups_list_pending"), status, strings.Join(pending, ", "))
+	}
+	return status
+}
\ No newline at end of file
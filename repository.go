@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 去重複備份倉庫 (相對備份目錄)
+const (
+	repositoryDirName = "repository"
+	chunksDirName     = "chunks"
+	snapshotsDirName  = "snapshots"
+	// 建立 snapshot 與清理 chunk 時持有 命令列與管理器不會同時寫入
+	repositoryLockName = "lock"
+)
+
+// content-defined chunking 參數 平均約 1 MiB
+const (
+	chunkMinSize = 256 << 10
+	chunkMaxSize = 4 << 20
+	chunkMask    = 1<<20 - 1
+)
+
+// gearTable chunk 邊界使用的 gear hash 表 (固定種子 不可更改 否則無法去重複)
+var gearTable = func() (table [256]uint64) {
+	seed := uint64(0x9E3779B97F4A7C15)
+	for i := range table {
+		seed += 0x9E3779B97F4A7C15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Snapshot 倉庫中的一次備份 記錄每個檔案由哪些 chunk 組成
+type Snapshot struct {
+	Version int               `json:"version"`
+	Created time.Time         `json:"created"`
+	Files   []SnapshotFile    `json:"files"`
+	Failed  []ManifestFailure `json:"failed,omitempty"`
+}
+
+// SnapshotFile
+type SnapshotFile struct {
+	Path    string        `json:"path"`
+	Size    int64         `json:"size"`
+	ModTime time.Time     `json:"mtime"`
+	SHA256  string        `json:"sha256"`
+	Chunks  []string      `json:"chunks"`
+	Region  *RegionLayout `json:"region,omitempty"`
+}
+
+type repository struct {
+	root string
+}
+
+// openRepository 備份目錄 dir 中的倉庫
+func openRepository(dir string) (*repository, error) {
+	repo := &repository{root: filepath.Join(dir, repositoryDirName)}
+	for _, dir := range []string{chunksDirName, snapshotsDirName} {
+		if err := os.MkdirAll(filepath.Join(repo.root, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// lock 取得倉庫的獨佔鎖
+func (r *repository) lock() (unlock func(), err error) {
+	return lockFile(filepath.Join(r.root, repositoryLockName))
+}
+
+// hasRepository 備份目錄中是否已有倉庫
+func hasRepository(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, repositoryDirName))
+	return err == nil && info.IsDir()
+}
+
+// isSnapshotFile catalog 中的名稱是否為倉庫 snapshot
+func isSnapshotFile(name string) bool {
+	return strings.HasPrefix(name, repositoryDirName+"/"+snapshotsDirName+"/")
+}
+
+// snapshotCatalogName snapshot 在 catalog 中的名稱 (相對備份目錄)
+func snapshotCatalogName(job *BackupJob, startTime time.Time, request backupRequest) string {
+	return fmt.Sprintf("%s/%s/%s.json", repositoryDirName, snapshotsDirName, backupBaseName(job, startTime, request))
+}
+
+// chunkPath
+func (r *repository) chunkPath(hash string) string {
+	return filepath.Join(r.root, chunksDirName, hash[:2], hash)
+}
+
+// putChunk 儲存 chunk 已存在時略過 回傳新寫入的位元組數
+func (r *repository) putChunk(hash string, data []byte) (int64, error) {
+	path := r.chunkPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return 0, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".*"+partialSuffix)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	compressor, err := flate.NewWriter(tmp, config.Backup.CompressionLevel)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if _, err := compressor.Write(data); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := compressor.Close(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return size, os.Rename(tmp.Name(), path)
+}
+
+// readChunk 讀取並檢查 chunk 內容
+func (r *repository) readChunk(hash string) ([]byte, error) {
+	compressed, err := os.ReadFile(r.chunkPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", hash, err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, fmt.Errorf(I18n("repository_chunk_corrupted"), hash)
+	}
+	return data, nil
+}
+
+// storeFile 將檔案切成 chunk 存入倉庫 回傳檔案紀錄與新寫入的位元組數
+func (r *repository) storeFile(filePath string) (SnapshotFile, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return SnapshotFile{}, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return SnapshotFile{}, 0, err
+	}
+
+	entry := SnapshotFile{Path: archiveEntryName(filePath), ModTime: info.ModTime()}
+	if isRegionFile(filePath) {
+		regionEntry, added, err := r.storeRegionFile(filePath, entry)
+		if !errors.Is(err, errNotRegionFile) {
+			return regionEntry, added, err
+		}
+	}
+
+	fileHasher := sha256.New()
+	var added int64
+	err = splitChunks(file, func(data []byte) error {
+		fileHasher.Write(data)
+		entry.Size += int64(len(data))
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		n, err := r.putChunk(hash, data)
+		added += n
+		entry.Chunks = append(entry.Chunks, hash)
+		return err
+	})
+	if err != nil {
+		return SnapshotFile{}, added, err
+	}
+	entry.SHA256 = hex.EncodeToString(fileHasher.Sum(nil))
+	return entry, added, nil
+}
+
+// splitChunks 以 gear hash 找出內容定義的 chunk 邊界
+func splitChunks(reader io.Reader, fn func([]byte) error) error {
+	buf := make([]byte, chunkMaxSize)
+	filled := 0
+	eof := false
+	for {
+		if !eof {
+			n, err := io.ReadFull(reader, buf[filled:])
+			filled += n
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if filled == 0 {
+			return nil
+		}
+
+		size := chunkBoundary(buf[:filled])
+		if err := fn(buf[:size]); err != nil {
+			return err
+		}
+		filled = copy(buf, buf[size:filled])
+	}
+}
+
+// chunkBoundary data 中第一個 chunk 的長度
+func chunkBoundary(data []byte) int {
+	if len(data) <= chunkMinSize {
+		return len(data)
+	}
+	var hash uint64
+	for i := chunkMinSize; i < len(data); i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// snapshotPath
+func (r *repository) snapshotPath(catalogName string) string {
+	return filepath.Join(filepath.Dir(r.root), filepath.FromSlash(catalogName))
+}
+
+// writeSnapshot snapshot 最後才寫入 存在即代表所有 chunk 都已儲存
+func (r *repository) writeSnapshot(catalogName string, snapshot *Snapshot) (int64, error) {
+	sort.Slice(snapshot.Files, func(i, j int) bool { return snapshot.Files[i].Path < snapshot.Files[j].Path })
+	sort.Slice(snapshot.Failed, func(i, j int) bool { return snapshot.Failed[i].Path < snapshot.Failed[j].Path })
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return 0, err
+	}
+	path := r.snapshotPath(catalogName)
+	tmp := path + partialSuffix
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), os.Rename(tmp, path)
+}
+
+// loadSnapshot
+func loadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// createSnapshot 將檔案存入倉庫並建立 snapshot
+func createSnapshot(job *BackupJob, request backupRequest, startTime time.Time, files []string) (*backupResult, error) {
+	repo, err := openRepository(job.Destination)
+	if err != nil {
+		return nil, err
+	}
+	// 寫入 snapshot 前 已存在而略過的 chunk 不可被清理
+	unlock, err := repo.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	snapshot := &Snapshot{Version: 1, Created: startTime}
+	var mu sync.Mutex
+	var added int64
+	var wg sync.WaitGroup
+	jobs := make(chan string, len(files))
+
+	for i := 0; i < config.Backup.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				entry, n, err := repo.storeFile(path)
+				mu.Lock()
+				added += n
+				if err != nil {
+					log.Printf(I18n("backup_add_file_to_archive_failed"), path, err)
+					snapshot.Failed = append(snapshot.Failed, ManifestFailure{Path: archiveEntryName(path), Error: err.Error()})
+				} else {
+					snapshot.Files = append(snapshot.Files, entry)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, file := range files {
+		jobs <- file
+	}
+	close(jobs)
+	wg.Wait()
+
+	name := snapshotCatalogName(job, startTime, request)
+	size, err := repo.writeSnapshot(name, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf(I18n("repository_snapshot_created"), len(snapshot.Files), float64(added)/1024/1024)
+
+	var raw int64
+	for _, f := range snapshot.Files {
+		raw += f.Size
+	}
+
+	return &backupResult{
+		path:   repo.snapshotPath(name),
+		name:   name,
+		files:  len(snapshot.Files),
+		failed: len(snapshot.Failed),
+		size:   added + size,
+		raw:    raw,
+	}, nil
+}
+
+// verifySnapshot 重新組合每個檔案 檢查 chunk 與檔案的 SHA-256
+func verifySnapshot(path string) error {
+	snapshot, err := loadSnapshot(path)
+	if err != nil {
+		return err
+	}
+	repo, err := openRepository(backupDir(path))
+	if err != nil {
+		return err
+	}
+
+	var problems []error
+	for _, f := range snapshot.Files {
+		if len(problems) >= maxVerifyProblems {
+			break
+		}
+		hasher := sha256.New()
+		size, err := io.Copy(hasher, repo.fileReader(f))
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", f.Path, err))
+			continue
+		}
+		if size != f.Size || hex.EncodeToString(hasher.Sum(nil)) != f.SHA256 {
+			problems = append(problems, fmt.Errorf(I18n("verify_checksum_mismatch"), f.Path))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// fileReader 依序讀取檔案的所有 chunk
+func (r *repository) fileReader(f SnapshotFile) io.Reader {
+	residual := &chunkReader{repo: r, chunks: f.Chunks}
+	if f.Region != nil {
+		return &regionReader{repo: r, residual: residual, payloads: f.Region.Payloads}
+	}
+	return residual
+}
+
+type chunkReader struct {
+	repo   *repository
+	chunks []string
+	buf    []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if len(c.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := c.repo.readChunk(c.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		c.buf = data
+		c.chunks = c.chunks[1:]
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// repoUsage 倉庫空間使用與 chunk 參照計數 用於依大小清理
+type repoUsage struct {
+	repo      *repository
+	refs      map[string]int
+	sizes     map[string]int64
+	snapshots map[string][]string
+	stale     []string
+	total     int64
+}
+
+// loadRepoUsage
+func loadRepoUsage(dir string) (*repoUsage, error) {
+	repo, err := openRepository(dir)
+	if err != nil {
+		return nil, err
+	}
+	usage := &repoUsage{
+		repo:      repo,
+		refs:      make(map[string]int),
+		sizes:     make(map[string]int64),
+		snapshots: make(map[string][]string),
+	}
+
+	chunkRoot := filepath.Join(repo.root, chunksDirName)
+	err = filepath.WalkDir(chunkRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(d.Name(), partialSuffix) {
+			usage.stale = append(usage.stale, path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		usage.sizes[d.Name()] = info.Size()
+		usage.total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotRoot := filepath.Join(repo.root, snapshotsDirName)
+	entries, err := os.ReadDir(snapshotRoot)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(snapshotRoot, entry.Name())
+		snapshot, err := loadSnapshot(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		name := repositoryDirName + "/" + snapshotsDirName + "/" + entry.Name()
+		if info, err := entry.Info(); err == nil {
+			usage.sizes[name] = info.Size()
+			usage.total += info.Size()
+		}
+		var chunks []string
+		for _, f := range snapshot.Files {
+			chunks = append(chunks, f.Chunks...)
+			if f.Region != nil {
+				for _, p := range f.Region.Payloads {
+					chunks = append(chunks, p.Hash)
+				}
+			}
+		}
+		usage.snapshots[name] = chunks
+		for _, hash := range chunks {
+			usage.refs[hash]++
+		}
+	}
+	return usage, nil
+}
+
+// pinned 受保護的 snapshot 佔用的位元組數 (snapshot 檔與所有參照的 chunk) 刪除其他 snapshot 也無法釋放
+func (u *repoUsage) pinned(names []string) int64 {
+	var size int64
+	seen := make(map[string]bool)
+	for _, name := range names {
+		size += u.sizes[name]
+		for _, hash := range u.snapshots[name] {
+			if !seen[hash] {
+				seen[hash] = true
+				size += u.sizes[hash]
+			}
+		}
+	}
+	return size
+}
+
+// release 模擬刪除 snapshot 回傳可釋放的位元組數
+func (u *repoUsage) release(name string) int64 {
+	freed := u.sizes[name]
+	delete(u.sizes, name)
+	for _, hash := range u.snapshots[name] {
+		u.refs[hash]--
+		if u.refs[hash] == 0 {
+			freed += u.sizes[hash]
+		}
+	}
+	delete(u.snapshots, name)
+	u.total -= freed
+	return freed
+}
+
+// collectGarbage 刪除備份目錄 dir 的倉庫中沒有任何 snapshot 參照的 chunk
+func collectGarbage(dir string) {
+	unlock, err := (&repository{root: filepath.Join(dir, repositoryDirName)}).lock()
+	if err != nil {
+		log.Printf(I18n("repository_gc_failed"), err)
+		return
+	}
+	defer unlock()
+
+	usage, err := loadRepoUsage(dir)
+	if err != nil {
+		log.Printf(I18n("repository_gc_failed"), err)
+		return
+	}
+
+	for _, path := range usage.stale {
+		os.Remove(path)
+	}
+
+	removed := 0
+	var freed int64
+	for hash, size := range usage.sizes {
+		if usage.refs[hash] > 0 || isSnapshotFile(hash) {
+			continue
+		}
+		if err := os.Remove(usage.repo.chunkPath(hash)); err == nil {
+			removed++
+			freed += size
+		}
+	}
+	if removed > 0 {
+		log.Printf(I18n("repository_gc_done"), removed, float64(freed)/1024/1024)
+	}
+}
\ No newline at end of file
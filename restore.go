@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 還原前 現有檔案的隔離資料夾 (相對工作目錄)
+const quarantineDirName = "restore-quarantine"
+
+// restorePlan restore 將進行的變更
+type restorePlan struct {
+	roots   []string
+	created []string // 還原前不存在的 roots 失敗時刪除
+	entries []backupEntry
+	safe    map[string]bool
+	added   []string
+	changed []string
+	removed []string
+	unsafe  []string
+}
+
+// runRestoreCommand restore <archive|latest|timestamp> [--dry-run]
+func runRestoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "list changes without restoring")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New(I18n("restore_usage"))
+	}
+	return restoreBackup(positional[0], *dryRun)
+}
+
+// restoreBackup 停止伺服器 隔離現有檔案 解壓備份後重新啟動
+func restoreBackup(target string, dryRun bool) (err error) {
+	archivePath, err := resolveBackup(target)
+	if err != nil {
+		return err
+	}
+
+	source, err := openBackup(archivePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	workDir := mustGetwd()
+	plan, err := planRestore(workDir, source.entries())
+	if err != nil {
+		return err
+	}
+
+	log.Printf(I18n("restore_plan_summary"), archivePath, len(plan.entries), len(plan.added), len(plan.changed), len(plan.removed))
+	for _, name := range plan.unsafe {
+		log.Printf(I18n("restore_unsafe_entry_skipped"), name)
+	}
+
+	if dryRun {
+		for _, root := range plan.roots {
+			log.Printf(I18n("restore_dry_run_quarantine"), root)
+		}
+		for _, name := range plan.added {
+			log.Printf("  + %s", name)
+		}
+		for _, name := range plan.changed {
+			log.Printf("  ~ %s", name)
+		}
+		for _, name := range plan.removed {
+			log.Printf("  - %s", name)
+		}
+		return nil
+	}
+
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
+
+	release := console.stopAndHold()
+
+	var quarantineDir string
+	var quarantined []string
+	// 失敗時刪除新建的 roots 並將隔離的檔案移回原位 移回也失敗時不啟動伺服器
+	defer func() {
+		if err != nil {
+			if rollbackErr := rollbackRestore(workDir, quarantineDir, quarantined, plan.created); rollbackErr != nil {
+				log.Printf(I18n("restore_rollback_failed"), rollbackErr, quarantineDir)
+				return
+			}
+		}
+		release()
+	}()
+
+	// 同一秒內再次還原時 (例如失敗後立即重試) 使用不同的資料夾
+	if len(plan.roots) > 0 {
+		if err = os.MkdirAll(filepath.Join(workDir, quarantineDirName), 0755); err != nil {
+			return err
+		}
+		quarantineDir, err = os.MkdirTemp(filepath.Join(workDir, quarantineDirName), time.Now().Format("2006-01-02_15-04-05")+"-*")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, root := range plan.roots {
+		dst := filepath.Join(quarantineDir, root)
+		if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf(I18n("restore_quarantine_failed"), root, err)
+		}
+		if err = os.Rename(filepath.Join(workDir, root), dst); err != nil {
+			return fmt.Errorf(I18n("restore_quarantine_failed"), root, err)
+		}
+		quarantined = append(quarantined, root)
+		log.Printf(I18n("restore_quarantined"), root, dst)
+	}
+
+	restored := 0
+	err = source.walk(func(entry backupEntry, reader io.Reader) error {
+		if !plan.safe[entry.Name] {
+			return nil
+		}
+		if err := extractFile(entry, reader, filepath.Join(workDir, filepath.FromSlash(entry.Name))); err != nil {
+			return fmt.Errorf(I18n("restore_extract_failed"), entry.Name, err)
+		}
+		restored++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf(I18n("restore_successful"), archivePath, restored)
+	return nil
+}
+
+// rollbackRestore 刪除已解壓的檔案與新建的 created 將隔離的 roots 移回原位
+func rollbackRestore(workDir, quarantineDir string, roots, created []string) error {
+	for _, root := range created {
+		if err := os.RemoveAll(filepath.Join(workDir, root)); err != nil {
+			return err
+		}
+	}
+	for _, root := range roots {
+		target := filepath.Join(workDir, root)
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(quarantineDir, root), target); err != nil {
+			return err
+		}
+	}
+	if len(roots) > 0 {
+		log.Printf(I18n("restore_rolled_back"), quarantineDir)
+	}
+	return nil
+}
+
+// resolveBackup 將 archive 路徑 / latest / 時間戳 轉為備份檔路徑 搜尋所有 job 的備份目錄
+func resolveBackup(target string) (string, error) {
+	dirs := backupDestinations()
+	var latest string
+	var latestTime time.Time
+	var matches, matchNames []string
+	for _, dir := range dirs {
+		backups, err := listBackups(dir)
+		if err != nil {
+			return "", err
+		}
+		for _, b := range backups {
+			path := filepath.Join(dir, filepath.FromSlash(b.File))
+			if latest == "" || !b.Time.Before(latestTime) {
+				latest, latestTime = path, b.Time
+			}
+			if strings.Contains(b.File, target) {
+				matches = append(matches, path)
+				matchNames = append(matchNames, b.File)
+			}
+		}
+	}
+
+	if target == "latest" {
+		if latest == "" {
+			return "", errors.New(I18n("restore_no_backups"))
+		}
+		return latest, nil
+	}
+
+	candidates := []string{target}
+	for _, dir := range dirs {
+		candidates = append(candidates, filepath.Join(dir, target))
+	}
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf(I18n("restore_backup_not_found"), target)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf(I18n("restore_backup_ambiguous"), target, strings.Join(matchNames, ", "))
+	}
+}
+
+// planRestore 比對備份內容與現有檔案
+func planRestore(workDir string, entries []backupEntry) (*restorePlan, error) {
+	plan := &restorePlan{safe: make(map[string]bool)}
+	inArchive := make(map[string]bool)
+	roots := make(map[string]bool)
+
+	for _, f := range entries {
+		name := filepath.FromSlash(f.Name)
+		if !filepath.IsLocal(name) {
+			plan.unsafe = append(plan.unsafe, f.Name)
+			continue
+		}
+		name = filepath.Clean(name)
+		plan.entries = append(plan.entries, f)
+		plan.safe[f.Name] = true
+		inArchive[name] = true
+		roots[restoreRoot(workDir, name)] = true
+
+		info, err := os.Stat(filepath.Join(workDir, name))
+		switch {
+		case err != nil:
+			plan.added = append(plan.added, name)
+		case info.Size() != f.Size || info.ModTime().Unix() != f.Modified.Unix():
+			plan.changed = append(plan.changed, name)
+		}
+	}
+
+	for root := range roots {
+		if isNestedRoot(root, roots) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(workDir, root)); err != nil {
+			plan.created = append(plan.created, root)
+			continue
+		}
+		plan.roots = append(plan.roots, root)
+
+		err := filepath.WalkDir(filepath.Join(workDir, root), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(workDir, path)
+			if err != nil {
+				return err
+			}
+			if !inArchive[rel] {
+				plan.removed = append(plan.removed, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(plan.roots)
+	sort.Strings(plan.created)
+	sort.Strings(plan.added)
+	sort.Strings(plan.changed)
+	sort.Strings(plan.removed)
+	return plan, nil
+}
+
+// restoreRoot 項目所屬的備份來源 不屬於任何來源時使用第一層路徑
+func restoreRoot(workDir, name string) string {
+	for _, src := range backupSources() {
+		rel, err := filepath.Rel(workDir, src)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		if name == rel || strings.HasPrefix(name, rel+string(filepath.Separator)) {
+			return rel
+		}
+	}
+	return strings.SplitN(name, string(filepath.Separator), 2)[0]
+}
+
+// isNestedRoot root 是否位於另一個 root 之下
+func isNestedRoot(root string, roots map[string]bool) bool {
+	for other := range roots {
+		if other != root && strings.HasPrefix(root, other+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractFile
+func extractFile(entry backupEntry, reader io.Reader, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(target, entry.Modified, entry.Modified)
+}
\ No newline at end of file
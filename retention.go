@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// retentionRule 一條保留規則 每個時段保留最新的一個備份 共保留 count 個時段
+type retentionRule struct {
+	name   string
+	count  int
+	bucket func(t time.Time) string
+}
+
+// RetentionPolicy 保留規則 [backup] 與每個遠端各自設定
+type RetentionPolicy struct {
+	RetentionCount int `toml:"retention_count"`
+	KeepHourly     int `toml:"keep_hourly"`
+	KeepDaily      int `toml:"keep_daily"`
+	KeepWeekly     int `toml:"keep_weekly"`
+	KeepMonthly    int `toml:"keep_monthly"`
+	KeepYearly     int `toml:"keep_yearly"`
+}
+
+// rules 啟用的保留規則
+func (p RetentionPolicy) rules() []retentionRule {
+	rules := []retentionRule{
+		{"keep_last", p.RetentionCount, nil},
+		{"keep_hourly", p.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"keep_daily", p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"keep_weekly", p.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"keep_monthly", p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"keep_yearly", p.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	var enabled []retentionRule
+	for _, rule := range rules {
+		if rule.count > 0 {
+			enabled = append(enabled, rule)
+		}
+	}
+	return enabled
+}
+
+// 還在複製佇列中而保留的原因
+const pendingReplicationReason = "pending replication"
+
+// retentionDecision 一個備份是否保留 以及保留的原因
+type retentionDecision struct {
+	record  BackupRecord
+	reasons []string
+}
+
+func (d *retentionDecision) keep() bool {
+	return len(d.reasons) > 0
+}
+
+// jobBackups 屬於 job 的備份
+func jobBackups(backups []BackupRecord, job *BackupJob) []BackupRecord {
+	var own []BackupRecord
+	for _, b := range backups {
+		if b.Job == job.Name {
+			own = append(own, b)
+		}
+	}
+	return own
+}
+
+// planRetention 依備份時間套用 policy 的保留規則 own 為同一個 job 的備份 (由舊到新)
+// all 為備份目錄中的所有備份 用於找出增量備份依賴的基準 pending 為還在複製佇列中的備份
+func planRetention(all, own []BackupRecord, policy RetentionPolicy, pending map[string]bool) []retentionDecision {
+	decisions := make([]retentionDecision, len(own))
+	for i, rec := range own {
+		decisions[i].record = rec
+	}
+
+	// 損壞與受保護的備份不計入任何規則
+	for _, rule := range policy.rules() {
+		kept := 0
+		lastBucket := ""
+		for i := len(decisions) - 1; i >= 0 && kept < rule.count; i-- {
+			rec := decisions[i].record
+			if rec.Verified == verifyBad || rec.Pinned {
+				continue
+			}
+			if rule.bucket != nil {
+				bucket := rule.bucket(rec.Time)
+				if bucket == lastBucket {
+					continue
+				}
+				lastBucket = bucket
+			}
+			kept++
+			decisions[i].reasons = append(decisions[i].reasons, fmt.Sprintf("%s %d/%d", rule.name, kept, rule.count))
+		}
+	}
+
+	var oldestKept time.Time
+	for _, d := range decisions {
+		if d.keep() {
+			oldestKept = d.record.Time
+			break
+		}
+	}
+
+	// 最新的備份 受保護的備份 還沒複製到遠端的備份 與保留的增量備份所依賴的基準備份不可刪除
+	if n := len(decisions); n > 0 && !decisions[n-1].keep() && !decisions[n-1].record.Pinned {
+		decisions[n-1].reasons = append(decisions[n-1].reasons, "newest")
+	}
+	var kept []BackupRecord
+	for i := range decisions {
+		d := &decisions[i]
+		if d.record.Pinned {
+			d.reasons = append([]string{"pinned"}, d.reasons...)
+		}
+		if !d.keep() && pending[d.record.File] {
+			d.reasons = append(d.reasons, pendingReplicationReason)
+		}
+		if d.keep() {
+			kept = append(kept, d.record)
+		}
+	}
+	required := requiredBases(all, kept)
+	for i := range decisions {
+		d := &decisions[i]
+		if d.keep() {
+			continue
+		}
+		switch {
+		case required[d.record.File]:
+			d.reasons = append(d.reasons, "incremental base")
+		case d.record.Verified == verifyBad && !oldestKept.IsZero() && d.record.Time.After(oldestKept):
+			// 損壞的備份保留到比所有保留的備份都舊為止
+			d.reasons = append(d.reasons, "corrupted, newer than kept backups")
+		}
+	}
+	return decisions
+}
+
+// runPruneCommand prune [--dry-run] 依保留規則清理所有 job 的備份
+func runPruneCommand(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "list which backups each rule keeps without deleting")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return errors.New(I18n("backups_usage"))
+	}
+	if len(config.Backup.rules()) == 0 && config.Backup.MaxTotalSizeGB <= 0 {
+		log.Println(I18n("prune_no_rules"))
+		return nil
+	}
+
+	if !*dryRun {
+		backupMutex.Lock()
+		defer backupMutex.Unlock()
+		for _, job := range backupJobs {
+			cleanupBackups(job)
+		}
+		return nil
+	}
+
+	// 只設定大小限制時 沒有可以預覽的規則
+	if len(config.Backup.rules()) == 0 {
+		log.Printf(I18n("prune_size_limit_only"), config.Backup.MaxTotalSizeGB)
+		return nil
+	}
+	for _, job := range backupJobs {
+		backups, err := listBackups(job.Destination)
+		if err != nil {
+			return err
+		}
+		own := jobBackups(backups, job)
+		log.Printf(I18n("prune_job_header"), job.displayName(), job.Destination)
+
+		w := tabwriter.NewWriter(log.Writer(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, I18n("prune_list_header"))
+		pruned := 0
+		for _, d := range planRetention(backups, own, config.Backup.RetentionPolicy, pendingReplications(job.Destination)) {
+			action := "keep"
+			if !d.keep() {
+				action = "prune"
+				pruned++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.record.Time.Format("2006-01-02 15:04:05"), d.record.File, action, strings.Join(d.reasons, ", "))
+		}
+		w.Flush()
+		log.Printf(I18n("prune_summary"), len(own)-pruned, pruned)
+	}
+	return nil
+}
\ No newline at end of file
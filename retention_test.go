@@ -0,0 +1,183 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBackup 以時間 "2006-01-02 15:04" 命名的測試備份
+func testBackup(at string) BackupRecord {
+	t, err := time.Parse("2006-01-02 15:04", at)
+	if err != nil {
+		panic(err)
+	}
+	return BackupRecord{File: at, Time: t, Job: "world"}
+}
+
+func pinnedBackup(at string) BackupRecord {
+	rec := testBackup(at)
+	rec.Pinned = true
+	return rec
+}
+
+func corruptedBackup(at string) BackupRecord {
+	rec := testBackup(at)
+	rec.Verified = verifyBad
+	return rec
+}
+
+func incrementalBackup(at, base string) BackupRecord {
+	rec := testBackup(at)
+	rec.Base = base
+	return rec
+}
+
+func TestPlanRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		backups []BackupRecord // 由舊到新
+		pending []string
+		// 每個備份保留的原因 空字串表示刪除
+		want []string
+	}{
+		{
+			name:   "keep last",
+			policy: RetentionPolicy{RetentionCount: 2},
+			backups: []BackupRecord{
+				testBackup("2026-10-13 12:00"),
+				testBackup("2026-10-14 12:00"),
+				testBackup("2026-10-15 12:00"),
+				testBackup("2026-10-16 12:00"),
+			},
+			want: []string{"", "", "keep_last 2/2", "keep_last 1/2"},
+		},
+		{
+			name:   "keep daily keeps the newest of each day",
+			policy: RetentionPolicy{KeepDaily: 2},
+			backups: []BackupRecord{
+				testBackup("2026-10-14 08:00"),
+				testBackup("2026-10-14 20:00"),
+				testBackup("2026-10-15 08:00"),
+				testBackup("2026-10-15 20:00"),
+				testBackup("2026-10-16 08:00"),
+			},
+			want: []string{"", "", "", "keep_daily 2/2", "keep_daily 1/2"},
+		},
+		{
+			name:   "keep weekly uses iso weeks",
+			policy: RetentionPolicy{KeepWeekly: 3},
+			backups: []BackupRecord{
+				testBackup("2026-12-20 12:00"), // 星期日 2026-W51
+				testBackup("2026-12-21 12:00"), // 星期一 2026-W52
+				testBackup("2026-12-27 12:00"), // 星期日 2026-W52
+				testBackup("2026-12-28 12:00"), // 2026-W53
+				testBackup("2027-01-01 12:00"), // 仍是 2026-W53
+				testBackup("2027-01-04 12:00"), // 2027-W01
+			},
+			want: []string{"", "", "keep_weekly 3/3", "", "keep_weekly 2/3", "keep_weekly 1/3"},
+		},
+		{
+			name:   "keep monthly with keep daily",
+			policy: RetentionPolicy{KeepDaily: 1, KeepMonthly: 2},
+			backups: []BackupRecord{
+				testBackup("2026-09-15 12:00"),
+				testBackup("2026-09-30 23:59"),
+				testBackup("2026-10-01 00:00"),
+				testBackup("2026-10-16 12:00"),
+			},
+			want: []string{"", "keep_monthly 2/2", "", "keep_daily 1/1, keep_monthly 1/2"},
+		},
+		{
+			name:   "pinned backups are not counted",
+			policy: RetentionPolicy{KeepDaily: 2},
+			backups: []BackupRecord{
+				testBackup("2026-10-13 12:00"),
+				testBackup("2026-10-14 12:00"),
+				pinnedBackup("2026-10-15 12:00"),
+				testBackup("2026-10-16 12:00"),
+			},
+			want: []string{"", "keep_daily 2/2", "pinned", "keep_daily 1/2"},
+		},
+		{
+			name:   "pinned newest",
+			policy: RetentionPolicy{RetentionCount: 1},
+			backups: []BackupRecord{
+				testBackup("2026-10-14 12:00"),
+				testBackup("2026-10-15 12:00"),
+				pinnedBackup("2026-10-16 12:00"),
+			},
+			want: []string{"", "keep_last 1/1", "pinned"},
+		},
+		{
+			name:   "pending replication and its base",
+			policy: RetentionPolicy{KeepDaily: 1},
+			backups: []BackupRecord{
+				testBackup("2026-10-13 12:00"),
+				testBackup("2026-10-14 12:00"),
+				incrementalBackup("2026-10-15 12:00", "2026-10-14 12:00"),
+				testBackup("2026-10-16 12:00"),
+			},
+			pending: []string{"2026-10-15 12:00", "2026-10-16 12:00"},
+			want:    []string{"", "incremental base", pendingReplicationReason, "keep_daily 1/1"},
+		},
+		{
+			name:   "corrupted backups",
+			policy: RetentionPolicy{RetentionCount: 2},
+			backups: []BackupRecord{
+				testBackup("2026-10-12 12:00"),
+				corruptedBackup("2026-10-13 12:00"),
+				testBackup("2026-10-14 12:00"),
+				corruptedBackup("2026-10-15 12:00"),
+				testBackup("2026-10-16 12:00"),
+			},
+			want: []string{"", "", "keep_last 2/2", "corrupted, newer than kept backups", "keep_last 1/2"},
+		},
+		{
+			name:   "newest is always kept",
+			policy: RetentionPolicy{KeepMonthly: 1},
+			backups: []BackupRecord{
+				testBackup("2026-10-15 12:00"),
+				corruptedBackup("2026-10-16 12:00"),
+			},
+			want: []string{"keep_monthly 1/1", "newest"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pending := make(map[string]bool)
+			for _, file := range tt.pending {
+				pending[file] = true
+			}
+			decisions := planRetention(tt.backups, tt.backups, tt.policy, pending)
+			if len(decisions) != len(tt.want) {
+				t.Fatalf("%d decisions, expected %d", len(decisions), len(tt.want))
+			}
+			for i, d := range decisions {
+				if got := strings.Join(d.reasons, ", "); got != tt.want[i] {
+					t.Errorf("%s: %q, expected %q", d.record.File, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPlanRetentionIncrementalChain(t *testing.T) {
+	// 保留的增量備份依賴的整條基準鏈都要保留 all 中其他 job 的備份不受影響
+	full := testBackup("2026-10-14 12:00")
+	mid := incrementalBackup("2026-10-15 12:00", full.File)
+	other := testBackup("2026-10-15 18:00")
+	other.Job = "other"
+	newest := incrementalBackup("2026-10-16 12:00", mid.File)
+	all := []BackupRecord{full, mid, other, newest}
+	own := []BackupRecord{full, mid, newest}
+
+	decisions := planRetention(all, own, RetentionPolicy{RetentionCount: 1}, nil)
+	want := []string{"incremental base", "incremental base", "keep_last 1/1"}
+	for i, d := range decisions {
+		if got := strings.Join(d.reasons, ", "); got != want[i] {
+			t.Errorf("%s: %q, expected %q", d.record.File, got, want[i])
+		}
+	}
+}
\ No newline at end of file
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3 上傳 每個請求最多重試的次數
+const s3Attempts = 5
+
+// s3Store S3 相容的物件儲存 (AWS S3、MinIO、R2、B2...) 使用 SigV4 簽章
+type s3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	pathStyle bool
+	accessKey string
+	secretKey string
+	token     string
+	partSize  int64
+	client    *http.Client
+}
+
+// newS3Store 金鑰從環境變數讀取 不寫在設定檔中
+func newS3Store(remote *BackupRemote) (*s3Store, error) {
+	if remote.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	if remote.Region == "" {
+		remote.Region = "us-east-1"
+	}
+	if remote.Endpoint == "" {
+		remote.Endpoint = "https://s3." + remote.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(remote.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint '%s'", remote.Endpoint)
+	}
+	if remote.AccessKeyEnv == "" {
+		remote.AccessKeyEnv = "AWS_ACCESS_KEY_ID"
+	}
+	if remote.SecretKeyEnv == "" {
+		remote.SecretKeyEnv = "AWS_SECRET_ACCESS_KEY"
+	}
+	accessKey, secretKey := os.Getenv(remote.AccessKeyEnv), os.Getenv(remote.SecretKeyEnv)
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("environment variables %s and %s must be set", remote.AccessKeyEnv, remote.SecretKeyEnv)
+	}
+	// S3 分段最小 5 MiB
+	if remote.PartSizeMB < 5 {
+		remote.PartSizeMB = 16
+	}
+	return &s3Store{
+		endpoint:  endpoint,
+		region:    remote.Region,
+		bucket:    remote.Bucket,
+		prefix:    strings.Trim(remote.Prefix, "/"),
+		pathStyle: remote.PathStyle,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		partSize:  int64(remote.PartSizeMB) * 1024 * 1024,
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+// put 小檔案直接上傳 大檔案分段上傳 完成後比對遠端的大小與 ETag
+func (s *s3Store) put(name string, r io.ReadSeeker, size int64) error {
+	var etags []string
+	var err error
+	if size <= s.partSize {
+		etags, err = s.putObject(name, r, size)
+	} else {
+		etags, err = s.putMultipart(name, r)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodHead, name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.ContentLength != size {
+		return fmt.Errorf("uploaded %s is %d bytes, expected %d", name, resp.ContentLength, size)
+	}
+	// SSE-KMS 與 SSE-C 的 ETag 不是內容的 MD5 只比對大小 每段內容已由 Content-MD5 檢查
+	if s3ETagIsMD5(resp.Header) {
+		if remote := strings.Trim(resp.Header.Get("ETag"), `"`); !slices.Contains(etags, remote) {
+			return fmt.Errorf("uploaded %s has checksum %s, expected %s", name, remote, etags[0])
+		}
+	}
+	return nil
+}
+
+// s3ETagIsMD5 物件的 ETag 是否為內容的 MD5
+func s3ETagIsMD5(header http.Header) bool {
+	if header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return false
+	}
+	return !strings.HasPrefix(header.Get("X-Amz-Server-Side-Encryption"), "aws:kms")
+}
+
+// putObject 單次上傳 回傳預期的 ETag (內容的 MD5)
+func (s *s3Store) putObject(name string, r io.ReadSeeker, size int64) ([]string, error) {
+	data := make([]byte, size)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(data)
+	resp, err := s.do(http.MethodPut, name, nil, http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}, data)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return []string{hex.EncodeToString(sum[:])}, nil
+}
+
+// putMultipart 分段上傳 每段各自重試 失敗時取消上傳 回傳預期的 ETag
+func (s *s3Store) putMultipart(name string, r io.ReadSeeker) ([]string, error) {
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := s.doXML(http.MethodPost, name, url.Values{"uploads": {""}}, nil, &created); err != nil {
+		return nil, err
+	}
+	uploadID := url.Values{"uploadId": {created.UploadID}}
+
+	var complete s3CompleteMultipartUpload
+	var sums []byte
+	whole := md5.New()
+	buf := make([]byte, s.partSize)
+	upload := func() error {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		for number := 1; ; number++ {
+			n, err := io.ReadFull(r, buf)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			sum := md5.Sum(buf[:n])
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {created.UploadID}}
+			resp, err := s.do(http.MethodPut, name, query, http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}, buf[:n])
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			complete.Parts = append(complete.Parts, s3CompletedPart{number, resp.Header.Get("ETag")})
+			sums = append(sums, sum[:]...)
+			whole.Write(buf[:n])
+		}
+	}
+	err := upload()
+	if err == nil {
+		var body []byte
+		body, err = xml.Marshal(complete)
+		if err == nil {
+			// 完成上傳時 S3 可能回傳 200 但內容是錯誤
+			var completed struct {
+				XMLName xml.Name
+				Code    string `xml:"Code"`
+				Message string `xml:"Message"`
+			}
+			err = s.doXML(http.MethodPost, name, uploadID, body, &completed)
+			if err == nil && completed.XMLName.Local == "Error" {
+				err = fmt.Errorf("%s: %s", completed.Code, completed.Message)
+			}
+		}
+	}
+	if err != nil {
+		if resp, abortErr := s.do(http.MethodDelete, name, uploadID, nil, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+
+	// 分段上傳的 ETag 為各段 MD5 串接後的 MD5 加上段數 部分相容實作使用整個檔案的 MD5
+	sum := md5.Sum(sums)
+	return []string{
+		fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(complete.Parts)),
+		hex.EncodeToString(whole.Sum(nil)),
+	}, nil
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// get
+func (s *s3Store) get(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// remove
+func (s *s3Store) remove(name string) error {
+	resp, err := s.do(http.MethodDelete, name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// doXML 送出請求並解析 XML 回應
+func (s *s3Store) doXML(method, name string, query url.Values, body []byte, v any) error {
+	resp, err := s.do(method, name, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// do 簽章並送出請求 網路錯誤與 5xx 會重試 物件不存在時回傳 os.ErrNotExist
+func (s *s3Store) do(method, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var resp *http.Response
+	err := retry(s3Attempts, func() error {
+		req, err := s.newRequest(method, name, query, header, body)
+		if err != nil {
+			return &permanentError{err}
+		}
+		resp, err = s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = s3ResponseError(method, name, resp)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNotFound && method != http.MethodPost && query == nil:
+			return &permanentError{fmt.Errorf("%w: %v", os.ErrNotExist, err)}
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout:
+			return err
+		default:
+			return &permanentError{err}
+		}
+	})
+	return resp, err
+}
+
+// s3ResponseError 從錯誤回應中取出 S3 的錯誤代碼
+func s3ResponseError(method, name string, resp *http.Response) error {
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("%s %s: %s: %s", method, name, e.Code, e.Message)
+	}
+	return fmt.Errorf("%s %s: %s", method, name, resp.Status)
+}
+
+// newRequest 建立 AWS Signature Version 4 簽章的請求
+func (s *s3Store) newRequest(method, name string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	key := strings.TrimPrefix(s.prefix+"/"+name, "/")
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	now := time.Now().UTC()
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+
+	// 簽章的標頭: host 與所有 x-amz-* content-md5
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-md5" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.RawPath,
+		u.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{now.Format("20060102"), s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+	return req, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape SigV4 的 URI 編碼 只保留 A-Z a-z 0-9 - _ . ~
+func s3Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EscapePath 逐段編碼路徑
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery 依名稱排序的查詢字串
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
\ No newline at end of file
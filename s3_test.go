@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// fakeS3 記憶體中的 S3 只實作 s3Store 用到的 API 並檢查每個請求的 SigV4 簽章
+type fakeS3 struct {
+	t        *testing.T
+	mu       sync.Mutex
+	objects  map[string][]byte
+	etags    map[string]string
+	uploads  map[string]map[int][]byte
+	nextID   int
+	requests []string
+
+	// fail 回傳非零時以該狀態碼回應請求
+	fail func(r *http.Request) int
+	// head HEAD 回應額外的標頭
+	head http.Header
+	// etag 不為 nil 時取代 HEAD 回應的 ETag
+	etag func(key string) string
+	// completeError 完成分段上傳時回傳 200 但內容是錯誤
+	completeError bool
+}
+
+// newTestS3 啟動 fakeS3 並建立連線到它的 s3Store
+func newTestS3(t *testing.T) (*fakeS3, *s3Store) {
+	t.Helper()
+	fake := &fakeS3{
+		t:       t,
+		objects: make(map[string][]byte),
+		etags:   make(map[string]string),
+		uploads: make(map[string]map[int][]byte),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	delay := retryDelay
+	retryDelay = time.Millisecond
+	t.Cleanup(func() { retryDelay = delay })
+
+	t.Setenv("TEST_S3_ACCESS_KEY", testS3AccessKey)
+	t.Setenv("TEST_S3_SECRET_KEY", testS3SecretKey)
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	store, err := newS3Store(&BackupRemote{
+		Endpoint:     server.URL,
+		Region:       "eu-west-1",
+		Bucket:       "backups",
+		Prefix:       "/server/",
+		PathStyle:    true,
+		AccessKeyEnv: "TEST_S3_ACCESS_KEY",
+		SecretKeyEnv: "TEST_S3_SECRET_KEY",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 測試時使用很小的分段
+	store.partSize = 1024
+	return fake, store
+}
+
+// log 收到的請求 例如 "PUT server/a.zip?partNumber=1"
+func (f *fakeS3) log() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := verifySigV4(r, body); err != nil {
+		f.t.Errorf("%s %s: %v", r.Method, r.URL, err)
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/backups/")
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	entry := r.Method + " " + key
+	switch {
+	case query.Has("partNumber"):
+		entry += "?partNumber=" + query.Get("partNumber")
+	case query.Has("uploads"):
+		entry += "?uploads"
+	case query.Has("uploadId"):
+		entry += "?uploadId"
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, entry)
+	if f.fail != nil {
+		if status := f.fail(r); status != 0 {
+			writeS3Error(w, status, http.StatusText(status))
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		sum := md5.Sum(body)
+		if r.Header.Get("Content-Md5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeS3Error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		etag := hex.EncodeToString(sum[:])
+		if query.Has("partNumber") {
+			parts, ok := f.uploads[query.Get("uploadId")]
+			if !ok {
+				writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+				return
+			}
+			number, _ := strconv.Atoi(query.Get("partNumber"))
+			parts[number] = body
+		} else {
+			f.objects[key] = body
+			f.etags[key] = etag
+		}
+		w.Header().Set("ETag", `"`+etag+`"`)
+
+	case http.MethodPost:
+		if query.Has("uploads") {
+			f.nextID++
+			id := fmt.Sprintf("upload-%d", f.nextID)
+			f.uploads[id] = make(map[int][]byte)
+			fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+			return
+		}
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if f.completeError {
+			fmt.Fprint(w, "<Error><Code>InternalError</Code><Message>We encountered an internal error.</Message></Error>")
+			return
+		}
+		var complete s3CompleteMultipartUpload
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data, sums []byte
+		for i, part := range complete.Parts {
+			content, ok := parts[part.PartNumber]
+			sum := md5.Sum(content)
+			if !ok || part.PartNumber != i+1 || part.ETag != `"`+hex.EncodeToString(sum[:])+`"` {
+				writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, content...)
+			sums = append(sums, sum[:]...)
+		}
+		sum := md5.Sum(sums)
+		f.objects[key] = data
+		f.etags[key] = fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(complete.Parts))
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+
+	case http.MethodDelete:
+		if query.Has("uploadId") {
+			delete(f.uploads, query.Get("uploadId"))
+		} else {
+			delete(f.objects, key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodHead, http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		etag := f.etags[key]
+		if f.etag != nil {
+			etag = f.etag(key)
+		}
+		for k, v := range f.head {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", `"`+etag+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// writeS3Error S3 格式的錯誤回應
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, http.StatusText(status))
+}
+
+// verifySigV4 依收到的請求重新計算 SigV4 簽章 不使用 s3.go 的實作
+func verifySigV4(r *http.Request, body []byte) error {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return fmt.Errorf("missing AWS4-HMAC-SHA256 authorization: %q", r.Header.Get("Authorization"))
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(auth, ", ") {
+		k, v, _ := strings.Cut(field, "=")
+		fields[k] = v
+	}
+	date := r.Header.Get("X-Amz-Date")
+	if _, err := time.Parse("20060102T150405Z", date); err != nil {
+		return fmt.Errorf("invalid X-Amz-Date %q", date)
+	}
+	scope := date[:8] + "/eu-west-1/s3/aws4_request"
+	if fields["Credential"] != testS3AccessKey+"/"+scope {
+		return fmt.Errorf("credential %q, expected %q", fields["Credential"], testS3AccessKey+"/"+scope)
+	}
+	payloadHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadHash[:]) {
+		return fmt.Errorf("x-amz-content-sha256 does not match the body")
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	for _, required := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !slices.Contains(signed, required) {
+			return fmt.Errorf("%s is not signed: %s", required, fields["SignedHeaders"])
+		}
+	}
+	if r.Header.Get("Content-Md5") != "" && !slices.Contains(signed, "content-md5") {
+		return fmt.Errorf("content-md5 is not signed: %s", fields["SignedHeaders"])
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	// 查詢字串依名稱排序 空白編碼為 %20
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, strings.ReplaceAll(url.QueryEscape(k)+"="+url.QueryEscape(v), "+", "%20"))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + testS3SecretKey)
+	for _, part := range []string{date[:8], "eu-west-1", "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	if expected := hex.EncodeToString(hmacSHA256(key, stringToSign)); fields["Signature"] != expected {
+		return fmt.Errorf("signature %s, expected %s\n%s", fields["Signature"], expected, canonicalRequest)
+	}
+	return nil
+}
+
+// testData 長度為 n 的測試資料
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestS3PutObject(t *testing.T) {
+	fake, store := newTestS3(t)
+	data := testData(1000)
+	if err := store.put("2024 01/a+b.zip", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.objects["server/2024 01/a+b.zip"], data) {
+		t.Fatal("uploaded object does not match")
+	}
+
+	r, err := store.get("2024 01/a+b.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("get = %d bytes, %v", len(got), err)
+	}
+	if err := store.remove("2024 01/a+b.zip"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.get("2024 01/a+b.zip"); err == nil || !strings.Contains(err.Error(), "NoSuchKey") {
+		t.Fatalf("get after remove = %v", err)
+	}
+
+	expected := []string{"PUT server/2024 01/a+b.zip", "HEAD server/2024 01/a+b.zip", "GET server/2024 01/a+b.zip", "DELETE server/2024 01/a+b.zip", "GET server/2024 01/a+b.zip"}
+	if got := fake.log(); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("requests = %q, expected %q", got, expected)
+	}
+}
+
+func TestS3PutMultipart(t *testing.T) {
+	fake, store := newTestS3(t)
+	data := testData(2500)
+	if err := store.put("a.zip", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.objects["server/a.zip"], data) {
+		t.Fatal("uploaded object does not match")
+	}
+	if len(fake.uploads) != 0 {
+		t.Fatalf("%d uploads left open", len(fake.uploads))
+	}
+	expected := []string{
+		"POST server/a.zip?uploads",
+		"PUT server/a.zip?partNumber=1",
+		"PUT server/a.zip?partNumber=2",
+		"PUT server/a.zip?partNumber=3",
+		"POST server/a.zip?uploadId",
+		"HEAD server/a.zip",
+	}
+	if got := fake.log(); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("requests = %q, expected %q", got, expected)
+	}
+}
+
+func TestS3Retry(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			fake, store := newTestS3(t)
+			// 每種請求的第一次都失敗
+			seen := make(map[string]bool)
+			fake.fail = func(r *http.Request) int {
+				request := r.Method + " " + r.URL.RawQuery
+				if seen[request] {
+					return 0
+				}
+				seen[request] = true
+				return status
+			}
+			data := testData(1500)
+			if err := store.put("a.zip", bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(fake.objects["server/a.zip"], data) {
+				t.Fatal("uploaded object does not match")
+			}
+			if got := len(fake.log()); got != 10 {
+				t.Fatalf("%d requests, expected 10", got)
+			}
+		})
+	}
+}
+
+func TestS3RetryGivesUp(t *testing.T) {
+	fake, store := newTestS3(t)
+	fake.fail = func(r *http.Request) int { return http.StatusServiceUnavailable }
+	err := store.put("a.zip", bytes.NewReader(testData(10)), 10)
+	if err == nil || !strings.Contains(err.Error(), "Service Unavailable") {
+		t.Fatalf("put = %v", err)
+	}
+	if got := len(fake.log()); got != s3Attempts {
+		t.Fatalf("%d requests, expected %d", got, s3Attempts)
+	}
+}
+
+func TestS3MultipartAbort(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(f *fakeS3)
+		last  string
+	}{
+		{"part rejected", func(f *fakeS3) {
+			f.fail = func(r *http.Request) int {
+				if r.URL.Query().Get("partNumber") == "2" {
+					return http.StatusForbidden
+				}
+				return 0
+			}
+		}, "PUT server/a.zip?partNumber=2"},
+		{"complete error", func(f *fakeS3) {
+			f.completeError = true
+		}, "POST server/a.zip?uploadId"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, store := newTestS3(t)
+			tt.setup(fake)
+			if err := store.put("a.zip", bytes.NewReader(testData(2500)), 2500); err == nil {
+				t.Fatal("put succeeded")
+			}
+			if len(fake.uploads) != 0 {
+				t.Fatalf("%d uploads were not aborted", len(fake.uploads))
+			}
+			if _, ok := fake.objects["server/a.zip"]; ok {
+				t.Fatal("object exists after failed upload")
+			}
+			got := fake.log()
+			if len(got) < 2 || got[len(got)-2] != tt.last || got[len(got)-1] != "DELETE server/a.zip?uploadId" {
+				t.Fatalf("requests = %q, expected %s followed by abort", got, tt.last)
+			}
+		})
+	}
+}
+
+func TestS3ETagCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		head http.Header
+		ok   bool
+	}{
+		{"plain", nil, false},
+		{"SSE-S3", http.Header{"X-Amz-Server-Side-Encryption": {"AES256"}}, false},
+		{"SSE-KMS", http.Header{"X-Amz-Server-Side-Encryption": {"aws:kms"}}, true},
+		{"DSSE-KMS", http.Header{"X-Amz-Server-Side-Encryption": {"aws:kms:dsse"}}, true},
+		{"SSE-C", http.Header{"X-Amz-Server-Side-Encryption-Customer-Algorithm": {"AES256"}}, true},
+	}
+	for _, tt := range tests {
+		for _, size := range []int{500, 2500} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, size), func(t *testing.T) {
+				fake, store := newTestS3(t)
+				fake.head = tt.head
+				fake.etag = func(string) string { return "0123456789abcdef0123456789abcdef" }
+				err := store.put("a.zip", bytes.NewReader(testData(size)), int64(size))
+				if tt.ok && err != nil {
+					t.Fatalf("put = %v", err)
+				}
+				if !tt.ok && (err == nil || !strings.Contains(err.Error(), "checksum")) {
+					t.Fatalf("put = %v, expected checksum mismatch", err)
+				}
+			})
+		}
+	}
+}
+
+func TestS3SizeCheck(t *testing.T) {
+	fake, store := newTestS3(t)
+	fake.head = http.Header{"X-Amz-Server-Side-Encryption": {"aws:kms"}}
+	// 遠端的物件少了最後一個位元組
+	fake.fail = func(r *http.Request) int {
+		if r.Method == http.MethodHead {
+			fake.objects["server/a.zip"] = fake.objects["server/a.zip"][:99]
+		}
+		return 0
+	}
+	err := store.put("a.zip", bytes.NewReader(testData(100)), 100)
+	if err == nil || !strings.Contains(err.Error(), "99 bytes") {
+		t.Fatalf("put = %v, expected size mismatch", err)
+	}
+}
\ No newline at end of file
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftp 上傳最多重試的次數 每次重新連線
+const sftpAttempts = 3
+
+// sftpStore 透過 SSH 金鑰登入的遠端目錄
+type sftpStore struct {
+	addr   string
+	root   string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// newSFTPStore 只支援金鑰登入 主機金鑰以 known_hosts 檢查
+func newSFTPStore(remote *BackupRemote) (*sftpStore, error) {
+	if remote.Host == "" || remote.User == "" || remote.Path == "" {
+		return nil, errors.New("host, user and path are required")
+	}
+	if remote.Port == 0 {
+		remote.Port = 22
+	}
+	home, _ := os.UserHomeDir()
+	if remote.KeyFile == "" {
+		remote.KeyFile = filepath.Join(home, ".ssh", "id_ed25519")
+	}
+	if remote.KnownHosts == "" {
+		remote.KnownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	// 與 ssh 相同 ~ 代表家目錄
+	for _, p := range []*string{&remote.KeyFile, &remote.KnownHosts} {
+		if rest, ok := strings.CutPrefix(*p, "~/"); ok {
+			*p = filepath.Join(home, rest)
+		}
+	}
+
+	key, err := os.ReadFile(remote.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var signer ssh.Signer
+	if remote.KeyPassphraseEnv != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(os.Getenv(remote.KeyPassphraseEnv)))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key_file %s: %w", remote.KeyFile, err)
+	}
+	hostKeyCallback, err := knownhosts.New(remote.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("known_hosts %s: %w", remote.KnownHosts, err)
+	}
+
+	return &sftpStore{
+		addr: net.JoinHostPort(remote.Host, strconv.Itoa(remote.Port)),
+		root: remote.Path,
+		config: &ssh.ClientConfig{
+			User:            remote.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+	}, nil
+}
+
+// connect 沿用已建立的連線
+func (s *sftpStore) connect() (*sftp.Client, error) {
+	if s.client != nil {
+		return s.client, nil
+	}
+	conn, err := ssh.Dial("tcp", s.addr, s.config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := client.MkdirAll(s.root); err != nil {
+		client.Close()
+		conn.Close()
+		return nil, err
+	}
+	s.conn, s.client = conn, client
+	return client, nil
+}
+
+// disconnect 發生錯誤後關閉連線 下次重新連線
+func (s *sftpStore) disconnect() {
+	if s.client != nil {
+		s.client.Close()
+		s.conn.Close()
+		s.conn, s.client = nil, nil
+	}
+}
+
+// withClient 連線錯誤時重新連線後重試
+func (s *sftpStore) withClient(fn func(client *sftp.Client) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return retry(sftpAttempts, func() error {
+		client, err := s.connect()
+		if err != nil {
+			return err
+		}
+		err = fn(client)
+		if errors.Is(err, os.ErrNotExist) {
+			return &permanentError{err}
+		}
+		if err != nil {
+			s.disconnect()
+		}
+		return err
+	})
+}
+
+// put 寫入 .partial 後比對大小與 SHA-256 再重新命名
+func (s *sftpStore) put(name string, r io.ReadSeeker, size int64) error {
+	target := path.Join(s.root, name)
+	partial := target + partialSuffix
+	return s.withClient(func(client *sftp.Client) error {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return &permanentError{err}
+		}
+		f, err := client.Create(partial)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = f.ReadFrom(io.TeeReader(r, h))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			client.Remove(partial)
+			return err
+		}
+
+		if err := s.verify(client, partial, size, hex.EncodeToString(h.Sum(nil))); err != nil {
+			client.Remove(partial)
+			return err
+		}
+		if err := client.PosixRename(partial, target); err != nil {
+			// 伺服器不支援 posix-rename 時先刪除舊檔
+			client.Remove(target)
+			return client.Rename(partial, target)
+		}
+		return nil
+	})
+}
+
+// verify 比對遠端檔案的大小與 SHA-256 可以執行 sha256sum 時在遠端計算 否則讀回比對
+func (s *sftpStore) verify(client *sftp.Client, name string, size int64, sum string) error {
+	info, err := client.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf("uploaded %s is %d bytes, expected %d", name, info.Size(), size)
+	}
+
+	remote, err := s.remoteSHA256(name)
+	if err != nil {
+		f, err := client.Open(name)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = f.WriteTo(h)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		remote = hex.EncodeToString(h.Sum(nil))
+	}
+	if remote != sum {
+		return fmt.Errorf("uploaded %s has SHA-256 %s, expected %s", name, remote, sum)
+	}
+	return nil
+}
+
+// remoteSHA256 以 sha256sum 在遠端計算校驗碼 只允許 SFTP 的主機會回傳錯誤
+func (s *sftpStore) remoteSHA256(name string) (string, error) {
+	session, err := s.conn.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	out, err := session.Output("sha256sum -- '" + strings.ReplaceAll(name, "'", `'\''`) + "'")
+	if err != nil {
+		return "", err
+	}
+	sum, _, _ := strings.Cut(string(out), " ")
+	if len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("unexpected sha256sum output %q", out)
+	}
+	return sum, nil
+}
+
+// get 讀取整個檔案後關閉 避免長時間佔用連線
+func (s *sftpStore) get(name string) (io.ReadCloser, error) {
+	var data []byte
+	err := s.withClient(func(client *sftp.Client) error {
+		f, err := client.Open(path.Join(s.root, name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		data, err = io.ReadAll(f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// remove
+func (s *sftpStore) remove(name string) error {
+	return s.withClient(func(client *sftp.Client) error {
+		return client.Remove(path.Join(s.root, name))
+	})
+}
\ No newline at end of file
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+)
+
+// sourceSize 備份來源目前的大小 (套用排除規則) 讀取錯誤略過 由之後的 collectFiles 回報
+func sourceSize(job *BackupJob) int64 {
+	var size int64
+	for _, sourcePath := range job.Sources {
+		rules := loadExcludeRules(sourcePath, job.Exclusions)
+		filepath.WalkDir(sourcePath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if rules.excluded(path, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.IsDir() {
+				if info, err := d.Info(); err == nil {
+					size += info.Size()
+				}
+			}
+			return nil
+		})
+	}
+	return size
+}
+
+// estimateBackupSize 以備份來源的大小與同一個 job 上次備份的壓縮率估計備份大小
+// 沒有紀錄時假設無法壓縮
+func estimateBackupSize(job *BackupJob) int64 {
+	raw := sourceSize(job)
+
+	ratio := 1.0
+	if backups, err := listBackups(job.Destination); err == nil {
+		own := jobBackups(backups, job)
+		for i := len(own) - 1; i >= 0; i-- {
+			if own[i].RawSize > 0 && !own[i].Partial {
+				ratio = min(float64(own[i].Size)/float64(own[i].RawSize), 1)
+				break
+			}
+		}
+	}
+	return int64(float64(raw) * ratio)
+}
+
+// ensureFreeSpace 備份後剩餘空間低於 min_free_space_gb 時先清理舊備份 仍不足時回傳錯誤
+// 在 save-off 之前執行 清理舊備份時伺服器仍可正常存檔
+func ensureFreeSpace(job *BackupJob) error {
+	reserve := int64(config.Backup.MinFreeSpaceGB * 1024 * 1024 * 1024)
+	if reserve <= 0 {
+		return nil
+	}
+	dir := job.Destination
+	free, err := diskFree(dir)
+	if err != nil {
+		// 無法取得剩餘空間時不阻擋備份
+		log.Printf(I18n("backup_free_space_unknown"), dir, err)
+		return nil
+	}
+	estimate := estimateBackupSize(job)
+	if config.Backup.VerifyAfterBackup && config.Backup.Encryption.enabled() && job.Format == formatZip {
+		// 驗證加密的 zip 時 會在備份目錄中解密出同樣大小的暫存檔
+		estimate *= 2
+	}
+	log.Printf(I18n("backup_free_space_estimate"), float64(estimate)/1024/1024, float64(free)/1e9)
+	if free-estimate >= reserve {
+		return nil
+	}
+
+	// 先套用平常的保留規則與大小限制 仍不足時依設定刪除更多舊備份
+	log.Printf(I18n("backup_free_space_low"), float64(free-estimate)/1e9, config.Backup.MinFreeSpaceGB)
+	enough := func() bool {
+		if free, err = diskFree(dir); err != nil {
+			return true
+		}
+		return free-estimate >= reserve
+	}
+	cleanupBackups(job)
+	if enough() {
+		return nil
+	}
+	if config.Backup.PruneForFreeSpace {
+		pruneForFreeSpace(job, estimate+reserve-free)
+		if enough() {
+			return nil
+		}
+	}
+	return fmt.Errorf(I18n("backup_free_space_insufficient"), float64(estimate)/1024/1024, float64(free)/1e9, config.Backup.MinFreeSpaceGB)
+}
+
+// pruneForFreeSpace 由舊到新刪除 job 的備份直到釋放 needed 位元組 保留最新的一個備份
+func pruneForFreeSpace(job *BackupJob, needed int64) {
+	dir := job.Destination
+	backups, err := listBackups(dir)
+	if err != nil {
+		log.Printf(I18n("backup_dir_get_failed"), err)
+		return
+	}
+	own := jobBackups(backups, job)
+	if len(own) < 2 {
+		return
+	}
+	newest := own[len(own)-1].File
+	// 還沒複製到遠端的備份不刪除
+	pending := pendingReplications(dir)
+
+	var usage *repoUsage
+	if hasRepository(dir) {
+		if usage, err = loadRepoUsage(dir); err != nil {
+			log.Printf(I18n("repository_gc_failed"), err)
+			return
+		}
+	}
+	deleted := pruneOldest(dir, backups, usage, func(b BackupRecord) bool {
+		return b.Job == job.Name && b.File != newest && !pending[b.File]
+	}, func(freed int64) bool {
+		return freed >= needed
+	})
+	for _, name := range deleted {
+		log.Printf(I18n("backup_pruned_for_free_space"), name)
+	}
+	forgetBackups(dir, deleted)
+	collectGarbageIfNeeded(dir, deleted)
+}
\ No newline at end of file
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 備份驗證狀態
+const (
+	verifyGood = "good"
+	verifyBad  = "bad"
+)
+
+// 單一備份最多回報幾個問題
+const maxVerifyProblems = 10
+
+// runVerifyCommand backups verify [archive|--all]
+func runVerifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	all := fs.Bool("all", false, "verify every backup")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 || (*all && len(positional) > 0) {
+		return errors.New(I18n("backups_usage"))
+	}
+
+	var targets []string
+	if *all {
+		for _, dir := range backupDestinations() {
+			records, err := listBackups(dir)
+			if err != nil {
+				return err
+			}
+			for _, rec := range records {
+				targets = append(targets, filepath.Join(dir, rec.File))
+			}
+		}
+	} else {
+		target := "latest"
+		if len(positional) == 1 {
+			target = positional[0]
+		}
+		path, err := resolveBackup(target)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, path)
+	}
+
+	bad := 0
+	for _, path := range targets {
+		if !verifyAndRecord(path) {
+			bad++
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf(I18n("verify_summary_failed"), bad, len(targets))
+	}
+	log.Printf(I18n("verify_summary_ok"), len(targets))
+	return nil
+}
+
+// verifyAndRecord 驗證備份並將結果寫入 catalog
+func verifyAndRecord(path string) bool {
+	dir := backupDir(path)
+	name := catalogName(dir, path)
+	status := verifyGood
+	if err := verifyBackup(path); err != nil {
+		status = verifyBad
+		log.Printf(I18n("verify_archive_bad"), name, err)
+	} else {
+		log.Printf(I18n("verify_archive_good"), name)
+	}
+	setVerified(dir, name, status)
+	return status == verifyGood
+}
+
+// verifyBackup 依備份類型驗證
+func verifyBackup(path string) error {
+	if strings.HasSuffix(path, ".json") {
+		return verifySnapshot(path)
+	}
+	return verifyArchive(path)
+}
+
+// verifyArchive 重新讀取備份 檢查每個項目的 CRC 與 manifest 中的 SHA-256
+func verifyArchive(path string) error {
+	type entryResult struct {
+		sum    string
+		size   int64
+		failed bool
+	}
+
+	var manifest *Manifest
+	var problems []error
+	results := make(map[string]entryResult)
+	err := walkArchive(path, func(entry backupEntry, reader io.Reader) error {
+		if entry.Name == manifestFileName {
+			var err error
+			if manifest, err = decodeManifest(reader); err != nil {
+				return fmt.Errorf("%s: %w", manifestFileName, err)
+			}
+			return nil
+		}
+		// 讀取整個項目 (zip 讀到結尾時會檢查 CRC)
+		hasher := sha256.New()
+		size, err := io.Copy(hasher, reader)
+		if err != nil {
+			if len(problems) < maxVerifyProblems {
+				problems = append(problems, fmt.Errorf("%s: %w", entry.Name, err))
+			}
+			results[entry.Name] = entryResult{failed: true}
+			return nil
+		}
+		results[entry.Name] = entryResult{sum: hex.EncodeToString(hasher.Sum(nil)), size: size}
+		return nil
+	})
+	if err != nil {
+		// 壓縮串流損壞後 之後的讀取會重複回報同一個錯誤
+		if len(problems) == 0 {
+			problems = append(problems, err)
+		}
+		return errors.Join(problems...)
+	}
+
+	if manifest == nil {
+		log.Printf(I18n("verify_no_manifest"), filepath.Base(path))
+		return errors.Join(problems...)
+	}
+	if manifest.Base != "" {
+		if _, err := os.Stat(filepath.Join(backupDir(path), filepath.FromSlash(manifest.Base))); err != nil {
+			problems = append(problems, fmt.Errorf(I18n("verify_base_missing"), manifest.Base))
+		}
+	}
+
+	expected := make(map[string]ManifestFile)
+	for _, f := range manifest.Files {
+		expected[f.Path] = f
+	}
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(problems) >= maxVerifyProblems {
+			break
+		}
+		got := results[name]
+		want, ok := expected[name]
+		switch {
+		case got.failed:
+		case !ok && manifest.failed(name):
+			// tar 中補零的項目 建立備份時已標示為不完整
+		case !ok:
+			problems = append(problems, fmt.Errorf(I18n("verify_not_in_manifest"), name))
+		case want.SHA256 != got.sum || want.Size != got.size:
+			problems = append(problems, fmt.Errorf(I18n("verify_checksum_mismatch"), name))
+		}
+	}
+	for _, f := range manifest.Files {
+		if len(problems) >= maxVerifyProblems {
+			break
+		}
+		if _, ok := results[f.Path]; !ok {
+			problems = append(problems, fmt.Errorf(I18n("verify_missing_entry"), f.Path))
+		}
+	}
+	return errors.Join(problems...)
+}
\ No newline at end of file